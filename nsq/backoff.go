@@ -0,0 +1,106 @@
+package nsq
+
+import (
+	"time"
+)
+
+// signals of the message responses from the connections.
+const (
+	// a job is requeued by failure
+	signalBackoff = iota
+	// a job is requeued by the handler without failure
+	signalContinue
+	// a job is finished
+	signalResume
+)
+
+// WithBackoff enables the backoff of the consumer, default is disabled.
+// When a job fails, the consumer stops receiving messages by RDY 0 in a window of base*2^(n-1) which is limited by max,
+// n is the consecutive failures. After the window, it tests the handlers by RDY 1,
+// every finished job decreases n, and RDY is restored when n is back to 0.
+func WithBackoff(base, max time.Duration) ConsumerOption {
+	if max < base {
+		max = base
+	}
+	return func(c *consumer) {
+		c.backoffBase = base
+		c.backoffMax = max
+	}
+}
+
+// Pause stops receiving messages by RDY 0 until Resume, the running jobs go on.
+// It's used to stop the consumption during the outage of the downstream without killing the process.
+func (c *consumer) Pause() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.paused {
+		return
+	}
+	c.paused = true
+	c.log.Info("msq-c pause:" + c.tube + "/" + c.channel)
+	c.updateRDY()
+}
+
+// Resume restores receiving messages after Pause.
+func (c *consumer) Resume() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.paused {
+		return
+	}
+	c.paused = false
+	c.log.Info("msq-c resume:" + c.tube + "/" + c.channel)
+	c.updateRDY()
+}
+
+// backoffWindow returns the window of the current backoff counter.
+func (c *consumer) backoffWindow() time.Duration {
+	d := c.backoffBase
+	for i := 1; i < c.backoffCounter && d < c.backoffMax; i++ {
+		d *= 2
+	}
+	if c.backoffMax > 0 && d > c.backoffMax {
+		d = c.backoffMax
+	}
+	return d
+}
+
+// onSignal updates the backoff state by the response of a job, need lock.
+// The signals in the backoff window are ignored as go-nsq does.
+func (c *consumer) onSignal(sig int) {
+	if c.backoffBase <= 0 || c.backoffTimer != nil {
+		return
+	}
+
+	updated := false
+	switch sig {
+	case signalBackoff:
+		if c.backoffCounter == 0 || c.backoffWindow() < c.backoffMax {
+			c.backoffCounter++
+		}
+		updated = true
+	case signalResume:
+		if c.backoffCounter > 0 {
+			c.backoffCounter--
+			updated = true
+		}
+	}
+
+	if c.backoffCounter == 0 {
+		if updated {
+			c.log.Info("msq-c backoff complete:" + c.tube + "/" + c.channel)
+			c.updateRDY()
+		}
+		return
+	}
+
+	window := c.backoffWindow()
+	c.log.Warn("msq-c backoff:" + c.tube + "/" + c.channel + " " + window.String())
+	c.backoffTimer = time.AfterFunc(window, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.backoffTimer = nil
+		c.updateRDY()
+	})
+	c.updateRDY()
+}
@@ -0,0 +1,88 @@
+package nsq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testClientRDY(s *testNsqd, rdy int) func() bool {
+	return func() bool {
+		for cli := range s.clients {
+			return cli.rdy == rdy
+		}
+		return false
+	}
+}
+
+func TestBackoffWindow(t *testing.T) {
+	c := &consumer{backoffBase: time.Second, backoffMax: 5 * time.Second}
+	for counter, expect := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		c.backoffCounter = counter
+		if d := c.backoffWindow(); d != expect {
+			t.Fatal(counter, d)
+		}
+	}
+}
+
+func TestConsumerBackoff(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	c := NewConsumer(s.Addr(), "testing_tube",
+		WithMaxInFlight(5),
+		WithBackoff(200*time.Millisecond, time.Second),
+		WithRetryPolicy(FixedRetry(time.Hour, 10)),
+	)
+	defer c.Close()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		if string(job.Body) == "fail" {
+			return Retry(nil)
+		}
+		return nil
+	})
+	if !s.Wait(time.Second, testClientRDY(s, 5)) {
+		t.Fatal("not ready")
+	}
+
+	// RDY 0 in the window, and 1 to test the handler after the window.
+	s.Publish("testing_tube", []byte("fail"))
+	if !s.Wait(time.Second, testClientRDY(s, 0)) {
+		t.Fatal("no backoff")
+	}
+	if !s.Wait(time.Second, testClientRDY(s, 1)) {
+		t.Fatal("no test")
+	}
+
+	// recovered by the finished job.
+	s.Publish("testing_tube", []byte("ok"))
+	if !s.Wait(time.Second, testClientRDY(s, 5)) {
+		t.Fatal("not recovered")
+	}
+}
+
+func TestConsumerPause(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	c := NewConsumer(s.Addr(), "testing_tube")
+	defer c.Close()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		return nil
+	})
+	if !s.Wait(time.Second, testClientRDY(s, 1)) {
+		t.Fatal("not ready")
+	}
+	c.Pause()
+	if !s.Wait(time.Second, testClientRDY(s, 0)) {
+		t.Fatal("not paused")
+	}
+	s.Publish("testing_tube", []byte("testing"))
+	if s.Wait(200*time.Millisecond, func() bool { return len(s.fin) > 0 }) {
+		t.Fatal("handled in pause")
+	}
+	c.Resume()
+	if !s.Wait(time.Second, func() bool { return len(s.fin) == 1 }) {
+		t.Fatal("not resumed")
+	}
+}
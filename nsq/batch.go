@@ -0,0 +1,198 @@
+package nsq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gwaylib/errors"
+)
+
+const (
+	defaultBatchSize   = 100
+	defaultBatchLinger = 10 * time.Millisecond
+)
+
+// WithBatch makes Put and PutTopic accumulate the messages by topic and publish them by MPUB,
+// a batch is published when it has size messages or bytes of MPUB body, or the linger passed since the first message.
+// Put returns the result of its batch, the defaults are 100 messages, the max body size and 10ms.
+func WithBatch(size, bytes int, linger time.Duration) ProducerOption {
+	return func(p *producer) {
+		if size <= 0 {
+			size = defaultBatchSize
+		}
+		if linger <= 0 {
+			linger = defaultBatchLinger
+		}
+		p.batch = &batcher{size: size, bytes: bytes, linger: linger}
+	}
+}
+
+// splitBody splits the messages by the max body size of MPUB,
+// the body is [4-byte count][4-byte size][data][4-byte size][data]...
+func splitBody(data [][]byte, maxBody int) ([][][]byte, error) {
+	parts := [][][]byte{}
+	start, size := 0, 4
+	for i, d := range data {
+		n := 4 + len(d)
+		if 4+n > maxBody {
+			return nil, ErrMessageTooBig.As(i, len(d), maxBody)
+		}
+		if size+n > maxBody {
+			parts = append(parts, data[start:i])
+			start, size = i, 4
+		}
+		size += n
+	}
+	if start < len(data) {
+		parts = append(parts, data[start:])
+	}
+	return parts, nil
+}
+
+type batchItem struct {
+	topic  string
+	data   []byte
+	result chan error
+}
+
+// pendingBatch is the messages accumulated for a topic.
+type pendingBatch struct {
+	topic string
+	items []*batchItem
+	size  int
+	timer *time.Timer
+}
+
+// publish publishes the batch by MPUB, every caller gets the result of the batch.
+// nsqd rejects the whole MPUB by a bad message, then the messages are published one by one,
+// so only the caller of the bad one fails.
+func (bt *pendingBatch) publish(p *producer) {
+	data := make([][]byte, len(bt.items))
+	for i, item := range bt.items {
+		data[i] = item.data
+	}
+	err := p.send(&spoolRecord{topic: bt.topic, data: data})
+	if len(bt.items) > 1 && (ErrBadMessage.Equal(err) || ErrMessageTooBig.Equal(err)) {
+		for _, item := range bt.items {
+			item.result <- p.send(&spoolRecord{topic: bt.topic, data: [][]byte{item.data}})
+		}
+		return
+	}
+	for _, item := range bt.items {
+		item.result <- err
+	}
+}
+
+// batcher accumulates the messages of Put by topic.
+type batcher struct {
+	size   int
+	bytes  int
+	linger time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	items  chan *batchItem
+	// the batches which passed the linger
+	expired chan *pendingBatch
+	done    chan bool
+	// the batches publishing
+	wg sync.WaitGroup
+}
+
+func (b *batcher) start(p *producer) {
+	if b.bytes <= 0 || b.bytes > p.maxBodySize {
+		b.bytes = p.maxBodySize
+	}
+	b.items = make(chan *batchItem, b.size)
+	b.expired = make(chan *pendingBatch)
+	b.done = make(chan bool)
+	go b.loop(p)
+}
+
+func (b *batcher) put(topic string, data []byte) error {
+	// the MPUB body of the message alone, see splitBody.
+	if 4+4+len(data) > b.bytes {
+		return ErrMessageTooBig.As(len(data), b.bytes)
+	}
+	item := &batchItem{topic: topic, data: data, result: make(chan error, 1)}
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return errors.New("producer has closed")
+	}
+	b.items <- item
+	b.mu.RUnlock()
+	return <-item.result
+}
+
+// close publishes the messages accumulated, and waits for the batches publishing.
+func (b *batcher) close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.items)
+	b.mu.Unlock()
+	<-b.done
+}
+
+func (b *batcher) loop(p *producer) {
+	batches := map[string]*pendingBatch{}
+	flush := func(bt *pendingBatch) {
+		delete(batches, bt.topic)
+		bt.timer.Stop()
+		// publish in background to accumulate the next batch, it's limited by the pool.
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			bt.publish(p)
+		}()
+	}
+
+	for {
+		select {
+		case item, ok := <-b.items:
+			if !ok {
+				for _, bt := range batches {
+					flush(bt)
+				}
+				b.wg.Wait()
+				close(b.done)
+				return
+			}
+			n := 4 + len(item.data)
+			bt := batches[item.topic]
+			if bt != nil && bt.size+n > b.bytes {
+				flush(bt)
+				bt = nil
+			}
+			if bt == nil {
+				bt = b.newBatch(item.topic)
+				batches[item.topic] = bt
+			}
+			bt.items = append(bt.items, item)
+			bt.size += n
+			if len(bt.items) >= b.size || bt.size >= b.bytes {
+				flush(bt)
+			}
+		case bt := <-b.expired:
+			// it may be flushed already.
+			if batches[bt.topic] == bt {
+				flush(bt)
+			}
+		}
+	}
+}
+
+func (b *batcher) newBatch(topic string) *pendingBatch {
+	bt := &pendingBatch{topic: topic, size: 4}
+	bt.timer = time.AfterFunc(b.linger, func() {
+		select {
+		case b.expired <- bt:
+		case <-b.done:
+		}
+	})
+	return bt
+}
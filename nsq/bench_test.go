@@ -0,0 +1,86 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// go test -bench . -benchtime 10000x
+//
+// 需要本地运行nsqd, 比较压缩前后的吞吐量
+const benchAddr = "127.0.0.1:4150"
+
+// benchBody makes a large json document.
+func benchBody() []byte {
+	items := make([]string, 200)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"id":%d,"name":"testing item %d","tags":["a","b","c"],"enabled":true}`, i, i)
+	}
+	return []byte(`{"items":[` + strings.Join(items, ",") + `]}`)
+}
+
+func checkNsqd(b *testing.B) {
+	conn, err := net.DialTimeout("tcp", benchAddr, time.Second)
+	if err != nil {
+		b.Skip("nsqd is not running:", err)
+	}
+	conn.Close()
+}
+
+func benchmarkPut(b *testing.B, comp Compression) {
+	checkNsqd(b)
+	p := NewProducer(10, benchAddr, "testing_bench_"+comp.String(), WithProducerCompression(comp))
+	defer p.Close()
+	body := benchBody()
+
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := p.Put(body); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPut(b *testing.B)        { benchmarkPut(b, CompressionNone) }
+func BenchmarkPutSnappy(b *testing.B)  { benchmarkPut(b, CompressionSnappy) }
+func BenchmarkPutDeflate(b *testing.B) { benchmarkPut(b, CompressionDeflate) }
+
+func benchmarkReserve(b *testing.B, comp Compression) {
+	checkNsqd(b)
+	tube := "testing_bench_reserve_" + comp.String()
+	p := NewProducer(10, benchAddr, tube, WithProducerCompression(comp))
+	defer p.Close()
+	body := benchBody()
+	for i := b.N; i > 0; i-- {
+		if err := p.Put(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	c := NewConsumer(benchAddr, tube, WithCompression(comp), WithConcurrency(10))
+	defer c.Close()
+	var handled int64
+	done := make(chan bool)
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		if atomic.AddInt64(&handled, 1) == int64(b.N) {
+			close(done)
+		}
+		return nil
+	})
+	<-done
+	b.StopTimer()
+}
+
+func BenchmarkReserve(b *testing.B)        { benchmarkReserve(b, CompressionNone) }
+func BenchmarkReserveSnappy(b *testing.B)  { benchmarkReserve(b, CompressionSnappy) }
+func BenchmarkReserveDeflate(b *testing.B) { benchmarkReserve(b, CompressionDeflate) }
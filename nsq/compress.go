@@ -0,0 +1,105 @@
+package nsq
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/gwaylib/errors"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// Compression is the compression of the nsqd connection which is negotiated in IDENTIFY.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionDeflate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionDeflate:
+		return "deflate"
+	}
+	return fmt.Sprintf("compression(%d)", int(c))
+}
+
+// WithCompression sets the compressions of the nsqd connections in order of preference, default is none.
+// If nsqd doesn't enable the preferred one, the next one is tried, and the connection is not compressed at last.
+func WithCompression(prefer ...Compression) ConsumerOption {
+	return func(c *consumer) {
+		c.compressions = prefer
+	}
+}
+
+// WithProducerCompression sets the compressions of the producer connections, see WithCompression.
+func WithProducerCompression(prefer ...Compression) ProducerOption {
+	return func(p *producer) {
+		p.compressions = prefer
+	}
+}
+
+// dial connects nsqd by the preferred compressions, setup is called before connecting.
+// nsqd disables the compressions which it doesn't support in IDENTIFY,
+// then the connection is made again with the next one.
+func (o *connOptions) dial(addr string, config *nsq.Config, delegate nsq.ConnDelegate, setup func(*nsq.Conn)) (*nsq.Conn, Compression, error) {
+	prefer := o.compressions
+	if len(prefer) == 0 {
+		// follow the base config
+		switch {
+		case config.Snappy:
+			prefer = []Compression{CompressionSnappy}
+		case config.Deflate:
+			prefer = []Compression{CompressionDeflate}
+		}
+	}
+	for i, comp := range prefer {
+		if comp == CompressionNone {
+			prefer = prefer[:i]
+			break
+		}
+	}
+
+	for i := 0; ; i++ {
+		comp := CompressionNone
+		if i < len(prefer) {
+			comp = prefer[i]
+		}
+		config.Snappy = comp == CompressionSnappy
+		config.Deflate = comp == CompressionDeflate
+
+		conn := nsq.NewConn(addr, config, delegate)
+		if setup != nil {
+			setup(conn)
+		}
+		resp, err := conn.Connect()
+		if err != nil {
+			if _, ok := err.(*net.OpError); ok {
+				return conn, comp, errors.As(err, addr)
+			}
+			err = connError(err, addr)
+			if isSecurityErr(err) || comp == CompressionNone {
+				return conn, comp, err
+			}
+			// try the next one if IDENTIFY is failed by the compression.
+			continue
+		}
+
+		enabled := comp == CompressionNone ||
+			(resp != nil && comp == CompressionSnappy && resp.Snappy) ||
+			(resp != nil && comp == CompressionDeflate && resp.Deflate)
+		if enabled {
+			return conn, comp, nil
+		}
+		if i+1 >= len(prefer) {
+			// no more compression to try, it's a plain connection already.
+			return conn, CompressionNone, nil
+		}
+		conn.Close()
+	}
+}
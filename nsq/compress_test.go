@@ -0,0 +1,99 @@
+package nsq
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	s := newTestNsqd(t, func(s *testNsqd) {
+		s.snappy = true
+		s.deflate = true
+	})
+	defer s.Close()
+
+	body := []byte(strings.Repeat(`{"name":"testing"}`, 1000))
+	p := NewProducer(1, s.Addr(), "testing_tube", WithProducerCompression(CompressionDeflate))
+	defer p.Close()
+	if err := p.Put(body); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConsumer(s.Addr(), "testing_tube", WithCompression(CompressionSnappy))
+	defer c.Close()
+	received := make(chan []byte, 1)
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		received <- job.Body
+		return nil
+	})
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, body) {
+			t.Fatal("body changed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not received")
+	}
+	if !s.Wait(time.Second, func() bool { return len(s.fin) == 1 }) {
+		t.Fatal("not finished")
+	}
+	if !s.Wait(0, func() bool { return strings.Join(s.compressions, ",") == "deflate,snappy" }) {
+		t.Fatal(s.compressions)
+	}
+}
+
+func TestCompressionFallback(t *testing.T) {
+	for i, c := range []struct {
+		snappy, deflate bool
+		prefer          []Compression
+		expect          string
+	}{
+		// the next one is tried when the preferred one is disabled.
+		{false, true, []Compression{CompressionSnappy, CompressionDeflate}, "none,deflate"},
+		// plain connection is kept when nothing is enabled.
+		{false, false, []Compression{CompressionSnappy}, "none"},
+		{false, false, []Compression{CompressionSnappy, CompressionDeflate}, "none,none"},
+		{true, true, []Compression{CompressionNone, CompressionSnappy}, "none"},
+	} {
+		s := newTestNsqd(t, func(s *testNsqd) {
+			s.snappy = c.snappy
+			s.deflate = c.deflate
+		})
+		p := NewProducer(1, s.Addr(), "testing_tube", WithProducerCompression(c.prefer...))
+		if err := p.Put([]byte("testing")); err != nil {
+			t.Fatal(i, err)
+		}
+		p.Close()
+		if !s.Wait(time.Second, func() bool { return len(s.pub["testing_tube"]) == 1 }) {
+			t.Fatal(i, "not published")
+		}
+		if !s.Wait(0, func() bool { return strings.Join(s.compressions, ",") == c.expect }) {
+			t.Fatal(i, s.compressions)
+		}
+		s.Close()
+	}
+}
+
+func TestCompressionFallbackPut(t *testing.T) {
+	s := newTestNsqd(t, func(s *testNsqd) {
+		s.deflate = true
+	})
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube", WithProducerCompression(CompressionSnappy, CompressionDeflate))
+	defer p.Close()
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	// the close event of the rejected snappy connection is arrived.
+	time.Sleep(300 * time.Millisecond)
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Wait(time.Second, func() bool { return len(s.pub["testing_tube"]) == 2 }) {
+		t.Fatal("not published")
+	}
+}
@@ -3,12 +3,15 @@
 //
 // c := NewConsumer("localhost:11130", "test")
 //
+// // 或通过nsqlookupd发现所有的nsqd节点
+// // c := NewLookupdConsumer([]string{"localhost:4161"}, "test")
+//
 // handle := func(ctx context.Context, job *Job, tried int) bool{
 //		// 处理结束后返回true删除数据
 //		return true
 // }
 //
-// 开启两个队列去并发读取
+// 开启两个队列去并发读取, 所有队列共享到每个nsqd的同一个连接
 // go c.Reserve(10 * time.Minute, handle)
 // go c.Reserve(10 * time.Minute, handle)
 //
@@ -20,16 +23,15 @@ package nsq
 import (
 	"context"
 	"io"
-	stdlog "log"
-	"net"
 	"os"
-	"runtime/debug"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gwaylib/errors"
-	"github.com/gwaylib/log"
 	"github.com/gwaylib/log/logger"
 	"github.com/gwaylib/log/logger/adapter/stdio"
 	"github.com/gwaylib/log/logger/proto"
@@ -41,315 +43,724 @@ func IsErrNotFound(err error) bool {
 }
 
 // 最大推送次数
+//
+// Deprecated: the give-up point is decided by RetryPolicy.
 const MAX_TRY_TIMES = 48 + 30 + 1
 
 type Job struct {
 	ID   nsq.MessageID
 	Body []byte
+
+	// decoded from the envelope, they're empty for the raw body except Timestamp.
+	Headers map[string]string
+	Source  string
+	// the time of the put, it's the time of nsqd for the raw body.
+	Timestamp time.Time
+	// deliveries of the job including the current one
+	Attempts int
+
+	msg *nsq.Message
+	// cancel of the handler context
+	cancel context.CancelFunc
+	// 1 when the next step of the job is decided.
+	settled int32
+	// requeues expected by PutDelay before the delivery.
+	deferrals int
+}
+
+// Touch resets the timeout of the job in nsqd,
+// the consumer touches the running jobs automatically, call it to extend the timeout explicitly.
+func (job *Job) Touch() {
+	if job.msg != nil {
+		job.msg.Touch()
+	}
+}
+
+// settle marks the next step of the job decided, only the first caller gets true,
+// so the result of a timed-out handler is ignored.
+func (job *Job) settle() bool {
+	return atomic.CompareAndSwapInt32(&job.settled, 0, 1)
+}
+
+// tried returns the deliveries before the current one,
+// it's counted by nsqd so it's shared by all consumers and survives restarts.
+func (job *Job) tried() int {
+	if job.msg == nil || int(job.msg.Attempts) <= job.deferrals {
+		return 0
+	}
+	return int(job.msg.Attempts) - 1 - job.deferrals
 }
 
 //
 // 若发送不成功
 // 返回true删除beanstalkd队件数据，否则不删除在一定时间后放回到就绪队中再次读取以便达到重试的效果。
-// 重试机制分别间隔以1次3秒钟、30次每分钟、48次每小时再次尝试发送, 若48小时后未能发送成功，数据将被强制删除。
+// 重试间隔由Consumer的RetryPolicy决定，默认为DefaultRetryPolicy, 放弃重试后数据将被强制删除。
 // 已放回就绪队列的次数通过tried进行了推送
 type HandleContext func(ctx context.Context, job *Job, tried int) bool
 
 type Consumer interface {
+	// Close is Shutdown without deadline.
 	io.Closer
 
+	// Shutdown stops receiving messages and waits for the running jobs finishing before closing the connections.
+	// If the ctx is done at first, the running jobs are requeued and a *ShutdownError is returned.
+	Shutdown(ctx context.Context) error
+
 	// timeout -- context.Context超时的时间
 	// handle -- 接收处理函数
+	// 阻塞至Consumer关闭, 关闭后返回nil, 若调用时已关闭返回ErrConsumerClosed
 	Reserve(timeout time.Duration, handle HandleContext) error
+
+	// ReserveHandler is the same as Reserve, but the handler decides the next step of the job by the returned error.
+	// It returns nil when the consumer is closed.
+	ReserveHandler(timeout time.Duration, handle Handler) error
+
+	// ReserveContext is the same as ReserveHandler, and ctx is the parent of every handler context,
+	// it returns ctx.Err() when ctx is done, or ErrConsumerClosed when the consumer is closed.
+	ReserveContext(ctx context.Context, timeout time.Duration, handle Handler) error
+
+	// Pause stops receiving messages by RDY 0 until Resume, the running jobs go on.
+	Pause()
+	// Resume restores receiving messages after Pause.
+	Resume()
+}
+
+// ErrConsumerClosed is returned by Reserve when the consumer is closed already,
+// and by ReserveContext when the consumer is closed.
+var ErrConsumerClosed = errors.New("Consumer has closed")
+
+// ShutdownError reports the jobs which are still running when the Shutdown is timeout.
+type ShutdownError struct {
+	Err     error
+	Running []nsq.MessageID
+}
+
+func (e *ShutdownError) Error() string {
+	ids := make([]string, len(e.Running))
+	for i, id := range e.Running {
+		ids[i] = string(id[:])
+	}
+	return "shutdown: " + e.Err.Error() + ", running jobs:[" + strings.Join(ids, ",") + "]"
+}
+
+// ConsumerOption sets an optional value of the Consumer.
+type ConsumerOption func(*consumer)
+
+// WithChannel sets the channel to subscribe, default is "default".
+// Every channel receives a copy of all the messages of the topic,
+// so the services which consume the same topic independently should use different channels.
+func WithChannel(channel string) ConsumerOption {
+	return func(c *consumer) {
+		c.channel = channel
+	}
+}
+
+// WithEphemeral subscribes an ephemeral channel which is deleted by nsqd when the last client disconnects,
+// and the messages are not persisted, it's used by the broadcast subscribers like cache invalidation.
+func WithEphemeral() ConsumerOption {
+	return func(c *consumer) {
+		c.ephemeral = true
+	}
+}
+
+// WithMaxInFlight sets the max messages in flight of the consumer, it's spread to the RDY of the nsqd connections,
+// every connection gets 1 at least. Default is the number of the running handlers.
+func WithMaxInFlight(n int) ConsumerOption {
+	return func(c *consumer) {
+		c.maxInFlight = n
+	}
+}
+
+// WithConcurrency sets the handler goroutines started by every Reserve call, default is 1.
+func WithConcurrency(n int) ConsumerOption {
+	return func(c *consumer) {
+		if n > 0 {
+			c.concurrency = n
+		}
+	}
+}
+
+// WithMsgTimeout sets the timeout of the messages delivered to the consumer in nsqd,
+// default is the msg-timeout of nsqd which is 60 seconds by default.
+// The running jobs are touched in the half of the timeout, so the handler can run longer than it.
+func WithMsgTimeout(timeout time.Duration) ConsumerOption {
+	return func(c *consumer) {
+		c.msgTimeout = timeout
+	}
+}
+
+// WithTimeoutDelay sets the requeue delay of the jobs which exceed the handler timeout,
+// default follows the RetryPolicy. The late results of the timed-out handlers are ignored.
+func WithTimeoutDelay(delay time.Duration) ConsumerOption {
+	return func(c *consumer) {
+		c.timeoutDelay = delay
+	}
+}
+
+// WithRetryPolicy sets the retry schedule of failed jobs, default is DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) ConsumerOption {
+	return func(c *consumer) {
+		c.retry = policy
+	}
 }
 
 type consumer struct {
-	addr     string
-	tube     string
+	// 日志器
+	log      proto.Logger
+	logLevel nsq.LogLevel
+	observer Observer
+	metrics  *Metrics
+	connOptions
+
+	addr        string
+	tube        string
+	channel     string
+	ephemeral   bool
+	lookupd     *lookupd
+	retry       RetryPolicy
+	deadLetter  Producer
+	maxInFlight int
+	concurrency int
+	msgTimeout  time.Duration
+	middlewares []Middleware
+	// negative follows the retry policy.
+	timeoutDelay time.Duration
+	backoffBase  time.Duration
+	backoffMax   time.Duration
+
+	// lock for connections.
+	mutex sync.Mutex
+	// server connections by addr, they are shared by all the workers.
+	conns    map[string]*nsq.Conn
+	delegate *Delegate
+	// running handler goroutines
+	handlers int
+	// stop receiving messages
+	draining bool
+	paused   bool
+	// consecutive failures of the backoff, and the timer of the backoff window.
+	backoffCounter int
+	backoffTimer   *time.Timer
+	// reconnecting state of the nodes which failed to connect.
+	retries map[string]*connRetry
+
+	// running jobs
+	jobMu sync.Mutex
+	jobs  map[nsq.MessageID]*Job
+	jobWg sync.WaitGroup
+
 	workerMu sync.Mutex
 	isClosed bool
-	workers  []io.Closer
+	running  bool
+	workers  []*worker
+
+	// signal command.
+	sig_exit chan bool
+	sig_end  chan bool
 }
 
-func NewConsumer(addr, tube string) Consumer {
+// NewConsumer create a Consumer of the nsqd addr, the options are optional,
+// and the connections use the defaults of go-nsq, see WithConfig.
+func NewConsumer(addr, tube string, opts ...ConsumerOption) Consumer {
 	c := &consumer{
-		addr:    addr,
-		tube:    tube,
-		workers: []io.Closer{},
+		log:          logger.New(tube, stdio.New(os.Stderr)),
+		logLevel:     nsq.LogLevelInfo,
+		metrics:      DefaultMetrics,
+		addr:         addr,
+		tube:         tube,
+		channel:      "default",
+		retry:        DefaultRetryPolicy,
+		concurrency:  1,
+		timeoutDelay: -1,
+		conns:        map[string]*nsq.Conn{},
+		retries:      map[string]*connRetry{},
+		delegate:     NewDelegate("consumer"),
+		jobs:         map[nsq.MessageID]*Job{},
+		workers:      []*worker{},
+		sig_exit:     make(chan bool),
+		sig_end:      make(chan bool, 1),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	if c.ephemeral && !strings.HasSuffix(c.channel, ephemeralSuffix) {
+		c.channel += ephemeralSuffix
+	}
+	if c.msgTimeout <= 0 && c.config != nil {
+		// touch the jobs by the timeout of the base config.
+		c.msgTimeout = c.config.MsgTimeout
+	}
+	c.delegate.log = c.log
+	c.delegate.observer = c.observer
 	return c
 }
 
+const ephemeralSuffix = "#ephemeral"
+
+var validName = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+(#ephemeral)?$`)
+
+// isValidName checks the topic or channel name as nsqd does.
+func isValidName(name string) bool {
+	if len(name) > 64 || len(name) < 1 {
+		return false
+	}
+	return validName.MatchString(name)
+}
+
+// nodes returns the nsqd addresses to connect.
+func (c *consumer) nodes() ([]string, error) {
+	addrs := []string{}
+	if len(c.addr) > 0 {
+		addrs = append(addrs, c.addr)
+	}
+	if c.lookupd == nil {
+		return addrs, nil
+	}
+	nodes, err := c.lookupd.Nodes(c.tube)
+	for _, n := range nodes {
+		if n != c.addr {
+			addrs = append(addrs, n)
+		}
+	}
+	return addrs, err
+}
+
 func (c *consumer) Reserve(timeout time.Duration, handle HandleContext) error {
+	return c.ReserveHandler(timeout, handle.Handler())
+}
+
+func (c *consumer) ReserveHandler(timeout time.Duration, handle Handler) error {
+	return c.reserve(context.Background(), timeout, handle)
+}
+
+func (c *consumer) ReserveContext(ctx context.Context, timeout time.Duration, handle Handler) error {
+	if err := c.reserve(ctx, timeout, handle); err != nil {
+		return err
+	}
+	return ErrConsumerClosed
+}
+
+// reserve blocks until the consumer is closed or ctx is done, it returns nil when the consumer is closed.
+func (c *consumer) reserve(ctx context.Context, timeout time.Duration, handle Handler) error {
 	c.workerMu.Lock()
 	if c.isClosed {
 		c.workerMu.Unlock()
-		return errors.New("Consumer has closed")
+		return ErrConsumerClosed
+	}
+	if !isValidName(c.channel) {
+		c.workerMu.Unlock()
+		return errors.New("invalid channel name").As(c.channel)
 	}
-	w := newConsumer(c.addr, c.tube, handle, timeout)
+	w := newWorker(ctx, c, Chain(c.middlewares...)(handle), timeout)
 	c.workers = append(c.workers, w)
+	if !c.running {
+		c.running = true
+		go c.run()
+	}
 	c.workerMu.Unlock()
 
-	w.reserve()
-	return nil
+	c.addHandlers(c.concurrency)
+	defer c.addHandlers(-c.concurrency)
+	defer c.delWorker(w)
+	w.reserve(c.concurrency)
+	return ctx.Err()
 }
-func (c *consumer) Close() error {
+
+// delWorker removes the worker which exits, Shutdown may be iterating the old slice.
+func (c *consumer) delWorker(w *worker) {
 	c.workerMu.Lock()
 	defer c.workerMu.Unlock()
-	for _, w := range c.workers {
-		w.Close()
+	workers := make([]*worker, 0, len(c.workers))
+	for _, cw := range c.workers {
+		if cw != w {
+			workers = append(workers, cw)
+		}
 	}
-	return nil
+	c.workers = workers
 }
 
-type worker struct {
-	// 日志器
-	log proto.Logger
-	// lock for Reader operator.
-	mutex sync.Mutex
-
-	// server addr
-	addr string
+func (c *consumer) Close() error {
+	return c.Shutdown(context.Background())
+}
 
-	// channle name
-	tubename string
+func (c *consumer) Shutdown(ctx context.Context) error {
+	c.workerMu.Lock()
+	if c.isClosed {
+		c.workerMu.Unlock()
+		return nil
+	}
+	c.isClosed = true
+	workers := c.workers
+	running := c.running
+	if running {
+		c.running = false
+		close(c.sig_exit)
+	}
+	c.workerMu.Unlock()
+	if running {
+		// run may be connecting a node, it doesn't connect again after the exit.
+		select {
+		case <-c.sig_end:
+		case <-ctx.Done():
+		}
+	}
 
-	// handle which is pushed
-	handle HandleContext
+	// stop receiving messages, the messages received after this are requeued.
+	c.mutex.Lock()
+	c.draining = true
+	c.updateRDY()
+	c.mutex.Unlock()
+	c.delegate.stop()
+	for _, w := range workers {
+		w.stop()
+	}
 
-	// server connection
-	conn     *nsq.Conn
-	delegate *Delegate
+	done := make(chan bool)
+	go func() {
+		for _, w := range workers {
+			w.wait()
+		}
+		c.jobWg.Wait()
+		close(done)
+	}()
 
-	// work timeout for dealock
-	workout time.Duration
+	var result error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// give the running jobs back to nsqd and stop the handlers, the late results of them are ignored.
+		running := c.runningJobs()
+		ids := make([]nsq.MessageID, len(running))
+		for i, job := range running {
+			ids[i] = job.ID
+			job.cancel()
+			if job.settle() {
+				job.msg.RequeueWithoutBackoff(0)
+				c.doneJob(job)
+			}
+		}
+		result = &ShutdownError{Err: ctx.Err(), Running: ids}
+	}
 
-	// log error times
-	connErrTimes int
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.disconn()
+	return result
+}
 
-	tryHistory map[nsq.MessageID]int
+func (c *consumer) addJob(job *Job) {
+	c.jobMu.Lock()
+	defer c.jobMu.Unlock()
+	c.jobs[job.ID] = job
+	c.jobWg.Add(1)
+	c.metrics.Add(metricConsumerInFlight, 1, c.labels()...)
+}
 
-	// signal command.
-	sig_exit_reserve chan bool
-	sig_end          chan bool
+// doneJob is called by the one who settled the job.
+func (c *consumer) doneJob(job *Job) {
+	c.jobMu.Lock()
+	defer c.jobMu.Unlock()
+	delete(c.jobs, job.ID)
+	c.jobWg.Done()
+	c.metrics.Add(metricConsumerInFlight, -1, c.labels()...)
 }
 
-func newConsumer(addr, tube string, handle HandleContext, timeout time.Duration) *worker {
-	return &worker{
-		log:              logger.New(tube, stdio.New(os.Stderr)),
-		mutex:            sync.Mutex{},
-		addr:             addr,
-		tubename:         tube,
-		handle:           handle,
-		workout:          timeout,
-		tryHistory:       make(map[nsq.MessageID]int),
-		sig_exit_reserve: make(chan bool, 1),
-		sig_end:          make(chan bool, 1),
-		delegate:         NewDelegate("consumer"),
+// runningJobs returns the running jobs in order of id.
+func (c *consumer) runningJobs() []*Job {
+	c.jobMu.Lock()
+	defer c.jobMu.Unlock()
+	jobs := make([]*Job, 0, len(c.jobs))
+	for _, job := range c.jobs {
+		jobs = append(jobs, job)
 	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return string(jobs[i].ID[:]) < string(jobs[j].ID[:])
+	})
+	return jobs
+}
+
+// addHandlers changes the number of the running handlers and spreads the RDY again.
+func (c *consumer) addHandlers(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handlers += n
+	c.updateRDY()
 }
 
-func (c *worker) reserve() {
+// run keeps the connections to the nsqd nodes.
+func (c *consumer) run() {
+	// check the nodes in time.
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	// 检查连接
+	c.checkConns()
 	for {
-		c.mutex.Lock()
-		// 检查连接
-		if c.conn == nil {
-			if err := c.connect(); err != nil {
-				c.mutex.Unlock()
-				c.log.Warn(errors.As(err))
-				continue
-			}
+		// the exit is prior to the others.
+		if c.exiting() {
+			c.sig_end <- true
+			return
 		}
-		c.mutex.Unlock()
-
 		select {
-		case <-c.sig_exit_reserve:
+		case <-c.sig_exit:
 			c.sig_end <- true
 			return
-		case msg := <-c.delegate.msg:
-			id, body := msg.ID, msg.Body
-			job := &Job{id, body}
+		case <-tick.C:
+			c.checkConns()
+		case conn := <-c.delegate.close:
 			c.mutex.Lock()
-			if err := c.do(job); err != nil {
-				c.log.Warn(err.Error())
-				c.disconn()
-				time.Sleep(10e9)
+			if c.conns[conn.String()] == conn {
+				delete(c.conns, conn.String())
+				c.log.Info("msq-c lost:" + conn.String())
+				c.updateRDY()
 			}
 			c.mutex.Unlock()
+			// reconnect at once
+			c.checkConns()
+		case <-c.delegate.backoff:
+			c.mutex.Lock()
+			c.onSignal(signalBackoff)
+			c.mutex.Unlock()
+		case <-c.delegate.goOn:
+			c.mutex.Lock()
+			c.onSignal(signalContinue)
+			c.mutex.Unlock()
+		case <-c.delegate.resume:
+			c.mutex.Lock()
+			c.onSignal(signalResume)
+			c.mutex.Unlock()
 		}
 	}
 }
 
-func (c *worker) Close() error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// exiting returns true if the consumer is shutting down.
+func (c *consumer) exiting() bool {
+	select {
+	case <-c.sig_exit:
+		return true
+	default:
+		return false
+	}
+}
 
-	c.sig_exit_reserve <- true
-	c.disconn()
-	<-c.sig_end
-	return nil
-}
-
-func (c *worker) connect() error {
-	// do close at first
-	if c.conn != nil {
-		c.disconn()
-	}
-
-	// connect
-	c.log.Info("msq-c connect:" + c.tubename)
-	//	config := nsq.NewConfig()
-	//	// so that the test can simulate binding consumer to specified address
-	//	config.LocalAddr, _ = net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	//	config.OutputBufferSize = 16384
-	config := nsq.NewConfig()
-	// so that the test can simulate binding consumer to specified address
-	config.LocalAddr, _ = net.ResolveTCPAddr("tcp", "127.0.0.1:0")
-	// so that the test can simulate reaching max requeues and a call to LogFailedMessage
-	config.DefaultRequeueDelay = 0
-	// so that the test wont timeout from backing off
-	config.MaxBackoffDuration = time.Millisecond * 50
-
-	conn := nsq.NewConn(c.addr, config, c.delegate)
-	_, err := conn.Connect()
+// checkConns connects to the new nodes and drops the nodes which are gone,
+// the failed nodes are reconnected after their retry time.
+// The nodes are dialed without the lock, a slow node doesn't block the others.
+func (c *consumer) checkConns() {
+	if c.exiting() {
+		return
+	}
+	addrs, err := c.nodes()
 	if err != nil {
-		c.connErrTimes++
-		c.dealConnErrTimes(c.connErrTimes, errors.As(err))
-		return errors.As(err)
+		// keep the connections of the last nodes.
+		c.log.Warn(errors.As(err))
 	}
-	c.conn = conn
-
-	conn.SetLogger(stdlog.New(os.Stderr, "", stdlog.Flags()), nsq.LogLevelDebug, "")
-	if err := conn.WriteCommand(nsq.Subscribe(c.tubename, "default")); err != nil {
-		c.disconn()
 
-		c.connErrTimes++
-		c.dealConnErrTimes(c.connErrTimes, errors.As(err))
-		return errors.As(err)
-	}
+	c.mutex.Lock()
+	dials := c.dropConns(addrs)
+	c.mutex.Unlock()
 
-	// TODO: fix this
-	count := int64(1)
-	conn.SetRDY(count)
-	if err := conn.WriteCommand(nsq.Ready(int(count))); err != nil {
-		c.disconn()
+	for _, addr := range dials {
+		if c.exiting() {
+			return
+		}
+		start := time.Now()
+		conn, err := c.connect(addr)
 
-		c.connErrTimes++
-		c.dealConnErrTimes(c.connErrTimes, errors.As(err))
-		return errors.As(err)
+		c.mutex.Lock()
+		if err != nil {
+			c.connFailed(addr, start, err)
+			c.mutex.Unlock()
+			c.log.Warn(errors.As(err))
+			continue
+		}
+		if c.exiting() {
+			// the connections are closed by Shutdown already.
+			closeConn(conn)
+			c.mutex.Unlock()
+			return
+		}
+		c.conns[addr] = conn
+		delete(c.retries, addr)
+		c.updateRDY()
+		c.mutex.Unlock()
 	}
+}
 
-	c.connErrTimes = 0
-	return nil
+// dropConns drops the connections which are dead or gone, and returns the nodes to connect, need lock.
+func (c *consumer) dropConns(addrs []string) []string {
+	now := time.Now()
+	alive := map[string]bool{}
+	dials := []string{}
+	changed := false
+	for _, addr := range addrs {
+		alive[addr] = true
+		if conn, ok := c.conns[addr]; ok {
+			if !conn.IsClosing() {
+				continue
+			}
+			// the close event may be missed, reconnect the dead connection.
+			delete(c.conns, addr)
+			c.log.Info("msq-c lost:" + addr)
+			changed = true
+		}
+		if r, ok := c.retries[addr]; ok && now.Before(r.next) {
+			continue
+		}
+		dials = append(dials, addr)
+	}
+	for addr := range c.conns {
+		if !alive[addr] {
+			c.disconnNode(addr)
+			changed = true
+		}
+	}
+	for addr := range c.retries {
+		if !alive[addr] {
+			delete(c.retries, addr)
+		}
+	}
+	if changed {
+		c.updateRDY()
+	}
+	return dials
 }
 
-// deal connction error
-func (c *worker) dealConnErrTimes(times int, err error) {
-	if err == nil {
-		err = errors.New("unknow error")
+// updateRDY spreads the max in flight to the connections.
+func (c *consumer) updateRDY() {
+	if len(c.conns) == 0 {
+		return
 	}
-	switch times {
-	case 10:
-		// if error times equal 10, make a error log.
-		c.log.Error(errors.As(err))
-	case 3:
-		// if error times equal 3, make warnning log.
-		c.log.Warn(errors.As(err))
+	total := c.maxInFlight
+	if total <= 0 {
+		total = c.handlers
+	}
+	switch {
+	case c.draining, c.paused, c.backoffTimer != nil:
+		total = 0
+	case c.backoffCounter > 0:
+		// test the handlers by one message in backoff.
+		total = 1
 	}
+	addrs := make([]string, 0, len(c.conns))
+	for addr := range c.conns {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
 
-	// if error times more than 10 times, do a sleep 30 sec.
-	if times > 10 {
-		time.Sleep(10 * 1e9)
-	} else {
-		time.Sleep(1 * 1e9)
+	per, rest := total/len(addrs), total%len(addrs)
+	for i, addr := range addrs {
+		count := per
+		if i < rest {
+			count++
+		}
+		if count < 1 && total > 0 && c.backoffCounter == 0 {
+			count = 1
+		}
+		conn := c.conns[addr]
+		if max := conn.MaxRDY(); max > 0 && int64(count) > max {
+			count = int(max)
+		}
+		if conn.LastRDY() == int64(count) {
+			continue
+		}
+		conn.SetRDY(int64(count))
+		if err := conn.WriteCommand(nsq.Ready(count)); err != nil {
+			c.log.Warn(errors.As(err, addr))
+		}
 	}
 }
 
-// do job
-func (c *worker) do(job *Job) error {
-	result := make(chan bool, 1)
-	ctx, cancel := context.WithTimeout(context.Background(), c.workout)
-	defer cancel()
+// connect dials the node and subscribes the topic, the RDY of the connection is 0 until it's added to the conns.
+func (c *consumer) connect(addr string) (*nsq.Conn, error) {
+	c.log.Info("msq-c connect:" + c.tube + "/" + c.channel + "@" + addr)
+	config := c.newConfig()
+	if c.msgTimeout > 0 {
+		config.MsgTimeout = c.msgTimeout
+	}
 
-	go func(ctx context.Context) {
-		deal := false
-		times, _ := c.tryHistory[job.ID]
+	conn, comp, err := c.dial(addr, config, c.delegate, func(conn *nsq.Conn) {
+		conn.SetLogger(&nsqLogger{c.log}, c.logLevel, "")
+	})
+	if err != nil {
+		c.delegate.emit(EventError, conn, err, nil)
+		return nil, err
+	}
+	if len(c.compressions) > 0 {
+		c.log.Info("msq-c compression:" + comp.String() + "@" + addr)
+	}
 
-		defer func() {
-			// recover for handle
-			if r := recover(); r != nil {
-				c.log.Error(errors.New("panic").As(r))
-				debug.PrintStack()
-				time.Sleep(10e9)
-				deal = false
-			}
+	if err := conn.WriteCommand(nsq.Subscribe(c.tube, c.channel)); err != nil {
+		closeConn(conn)
+		return nil, errors.As(err, addr)
+	}
+	return conn, nil
+}
 
-			if deal {
-				c.delJob(job)
-			} else {
-				c.nextTry(job)
-			}
-			result <- true
-			close(result)
-		}()
+// connRetry is the reconnecting state of a node.
+type connRetry struct {
+	// consecutive error times
+	times int
+	// the time to reconnect
+	next time.Time
+}
 
-		deal = c.handle(ctx, job, times)
-	}(ctx)
+// connFailed logs the connection error of the node, and delays the next connection of it from the start of the connection.
+func (c *consumer) connFailed(addr string, start time.Time, err error) {
+	r, ok := c.retries[addr]
+	if !ok {
+		r = &connRetry{}
+		c.retries[addr] = r
+	}
+	r.times++
+	switch {
+	case r.times == 1 && isSecurityErr(err):
+		// it needs the fix of the settings, report at once.
+		c.log.Error(err)
+	case r.times == 10:
+		// if error times equal 10, make a error log.
+		c.log.Error(errors.As(err, addr))
+	case r.times == 3:
+		// if error times equal 3, make warnning log.
+		c.log.Warn(errors.As(err, addr))
+	}
 
-	select {
-	case <-result:
-		return nil
-	case <-ctx.Done():
-		return errors.New("handle time out").As(ctx.Err(), job)
+	// if error times more than 10 times, retry after 10 sec.
+	if r.times > 10 {
+		r.next = start.Add(10 * time.Second)
+	} else {
+		r.next = start.Add(time.Second)
 	}
 }
 
-func (c *worker) nextTry(job *Job) {
-	id := job.ID
-	times, _ := c.tryHistory[id]
-	times += 1
-	c.tryHistory[id] = times
+// defaultMsgTimeout is the default msg-timeout of nsqd.
+const defaultMsgTimeout = 60 * time.Second
 
-	// 若发送不成功
-	// 分别间隔以1次3秒钟、30次每分钟、48次每小时再次尝试发送, 若48小时后未能发送成功，数据将被删除
-	sleep := 10
-	if times < 2 {
-		sleep = 3 // 3 sec.
-	} else if times < 30 {
-		sleep = 60 // 1 minute
-	} else if times < 78 {
-		sleep = 60 * 60 // 1 hour
-	} else {
-		c.log.Warn(errors.New("delete data").As(string(job.Body)))
-		// 48+6次后删除数据
-		// delete job
-		c.delJob(job)
-		return
+// touchInterval returns the interval to touch the running jobs.
+func (c *consumer) touchInterval() time.Duration {
+	timeout := c.msgTimeout
+	if timeout <= 0 {
+		timeout = defaultMsgTimeout
 	}
+	return timeout / 2
+}
 
-	if err := c.conn.WriteCommand(nsq.Requeue(job.ID, time.Duration(sleep*1e9))); err != nil {
-		// if err := c.conn.Conn.Release(job.ID, 0, time.Duration(sleep*1e9)); err != nil {
-		if !IsErrNotFound(err) {
-			c.log.Error(errors.As(err, job))
-		}
+func (c *consumer) disconn() {
+	for addr := range c.conns {
+		c.disconnNode(addr)
 	}
-	return
 }
 
-func (c *worker) delJob(job *Job) {
-	id := job.ID
-	delete(c.tryHistory, id)
-	if err := c.conn.WriteCommand(nsq.Finish(job.ID)); err != nil {
-		if !IsErrNotFound(err) {
-			log.Error(errors.As(err))
-		}
+func (c *consumer) disconnNode(addr string) {
+	if conn, ok := c.conns[addr]; ok {
+		closeConn(conn)
+		delete(c.conns, addr)
+		c.log.Info("msq-c closed:" + c.tube + "@" + addr)
 	}
 }
 
-func (c *worker) disconn() {
-	if c.conn != nil {
-		c.conn.Close()
-		c.conn = nil
-		c.log.Info("msq-c closed:" + c.tubename)
-	}
+// closeConn stops receiving messages, the connection is closed after the messages in flight are responded.
+func closeConn(conn *nsq.Conn) {
+	conn.WriteCommand(nsq.StartClose())
+	conn.Close()
 }
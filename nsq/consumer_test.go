@@ -1,10 +1,13 @@
 package nsq
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -61,3 +64,443 @@ func consumerTest(t *testing.T, cb func(c *nsq.Config)) {
 
 	time.Sleep(1e9)
 }
+
+func TestJobTried(t *testing.T) {
+	job := &Job{}
+	if job.tried() != 0 {
+		t.Fatal(job.tried())
+	}
+	msg := nsq.NewMessage(nsq.MessageID{}, []byte("testing"))
+	msg.Attempts = 3
+	job = &Job{ID: msg.ID, Body: msg.Body, msg: msg}
+	if job.tried() != 2 {
+		t.Fatal(job.tried())
+	}
+}
+
+func TestConsumerChannel(t *testing.T) {
+	c := NewConsumer(addr, topicName).(*consumer)
+	if c.channel != "default" {
+		t.Fatal(c.channel)
+	}
+	c = NewConsumer(addr, topicName, WithChannel("cache"), WithEphemeral(), WithEphemeral()).(*consumer)
+	if c.channel != "cache#ephemeral" {
+		t.Fatal(c.channel)
+	}
+	if !isValidName(c.channel) {
+		t.Fatal(c.channel)
+	}
+	// the channel set after WithEphemeral is ephemeral too.
+	c = NewConsumer(addr, topicName, WithEphemeral(), WithChannel("cache")).(*consumer)
+	if c.channel != "cache#ephemeral" {
+		t.Fatal(c.channel)
+	}
+	for _, name := range []string{"", "a b", "cache#ephemeral#ephemeral", strings.Repeat("a", 65)} {
+		if isValidName(name) {
+			t.Fatal(name)
+		}
+	}
+	if err := NewConsumer(addr, topicName, WithChannel("a b")).Reserve(time.Second, nil); err == nil {
+		t.Fatal("expect invalid channel")
+	}
+}
+
+func TestConsumerSharedConn(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	c := NewConsumer(s.Addr(), "testing_tube", WithConcurrency(2))
+	handled := make(chan string, 100)
+	handle := func(ctx context.Context, job *Job, tried int) error {
+		if string(job.Body) == "retry" {
+			return RetryAfter(time.Hour, nil)
+		}
+		handled <- string(job.Body)
+		return nil
+	}
+	for i := 5; i > 0; i-- {
+		go c.ReserveHandler(time.Minute, handle)
+	}
+	retryID := s.Publish("testing_tube", []byte("retry"))
+	for i := 0; i < 100; i++ {
+		s.Publish("testing_tube", []byte(fmt.Sprint(i)))
+	}
+	result := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		select {
+		case body := <-handled:
+			if result[body] {
+				t.Fatal("repeated", body)
+			}
+			result[body] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout", len(result))
+		}
+	}
+	if !s.Wait(time.Second, func() bool { return len(s.fin) == 100 && s.req[retryID] == time.Hour }) {
+		t.Fatal(len(s.fin), s.req)
+	}
+	if !s.Wait(time.Second, func() bool {
+		for cli := range s.clients {
+			return cli.rdy == 10 && cli.channel == "default"
+		}
+		return false
+	}) {
+		t.Fatal("rdy not spread")
+	}
+	if !s.Wait(0, func() bool { return s.conns == 1 }) {
+		t.Fatal("expect one connection")
+	}
+	c.Close()
+}
+
+func TestConsumerReconnect(t *testing.T) {
+	// the dead node is retried later without blocking.
+	down := freeAddr(t)
+	c := NewConsumer(down, "testing_tube").(*consumer)
+	c.checkConns()
+	start := time.Now()
+	c.checkConns()
+	if r := c.retries[down]; r == nil || r.times != 1 || time.Since(start) > 100*time.Millisecond {
+		t.Fatal(r, time.Since(start))
+	}
+
+	// the dead connection is reconnected though its close event is missed.
+	s := newTestNsqd(t)
+	defer s.Close()
+	c = NewConsumer(s.Addr(), "testing_tube").(*consumer)
+	defer c.Close()
+	c.checkConns()
+	dead := c.conns[s.Addr()]
+	if dead == nil {
+		t.Fatal("not connected")
+	}
+	dead.Close()
+	c.checkConns()
+	if conn := c.conns[s.Addr()]; conn == nil || conn == dead {
+		t.Fatal("not reconnected")
+	}
+	if !s.Wait(time.Second, func() bool { return s.conns == 2 }) {
+		t.Fatal(s.conns)
+	}
+}
+
+func TestConsumerTouch(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	c := NewConsumer(s.Addr(), "testing_tube", WithMsgTimeout(100*time.Millisecond))
+	defer c.Close()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		time.Sleep(300 * time.Millisecond)
+		job.Touch()
+		return nil
+	})
+	id := s.Publish("testing_tube", []byte("testing"))
+	if !s.Wait(5*time.Second, func() bool { return len(s.fin) == 1 }) {
+		t.Fatal("not finished")
+	}
+	if !s.Wait(0, func() bool { return s.touch[id] >= 4 }) {
+		t.Fatal("not touched", s.touch[id])
+	}
+}
+
+func TestConsumerShutdown(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	c := NewConsumer(s.Addr(), "testing_tube")
+	started := make(chan bool, 1)
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		started <- true
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+	s.Publish("testing_tube", []byte("testing1"))
+	<-started
+	s.Publish("testing_tube", []byte("testing2"))
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the running job is finished and the next one is not taken.
+	if !s.Wait(time.Second, func() bool { return len(s.fin) == 1 && len(s.clients) == 0 }) {
+		t.Fatal(len(s.fin), len(s.clients))
+	}
+	if err := c.Reserve(time.Minute, nil); err == nil {
+		t.Fatal("expect closed")
+	}
+}
+
+func TestConsumerShutdownTimeout(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	c := NewConsumer(s.Addr(), "testing_tube")
+	started := make(chan bool, 1)
+	canceled := make(chan bool, 1)
+	release := make(chan bool)
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		started <- true
+		<-ctx.Done()
+		canceled <- true
+		<-release
+		return nil
+	})
+	id := s.Publish("testing_tube", []byte("testing"))
+	<-started
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	err := c.Shutdown(ctx)
+	sErr, ok := err.(*ShutdownError)
+	if !ok || len(sErr.Running) != 1 || sErr.Running[0] != id {
+		t.Fatal(err)
+	}
+	// the handler of the requeued job is stopped.
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context not canceled")
+	}
+	close(release)
+	if !s.Wait(time.Second, func() bool { d, ok := s.req[id]; return ok && d == 0 && len(s.fin) == 0 }) {
+		t.Fatal(s.req, s.fin)
+	}
+}
+
+func TestConsumerCloseTimedOut(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	c := NewConsumer(s.Addr(), "testing_tube", WithTimeoutDelay(time.Hour))
+	release := make(chan bool)
+	defer close(release)
+	go c.ReserveHandler(100*time.Millisecond, func(ctx context.Context, job *Job, tried int) error {
+		// ignore the timeout
+		<-release
+		return nil
+	})
+	id := s.Publish("testing_tube", []byte("testing"))
+	if !s.Wait(time.Second, func() bool { return s.req[id] == time.Hour }) {
+		t.Fatal(s.req)
+	}
+	// Close doesn't wait for the handler of the requeued job.
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Close()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close blocked by the timed-out handler")
+	}
+}
+
+func TestConsumerPanic(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	c := NewConsumer(s.Addr(), "testing_tube", WithRetryPolicy(FixedRetry(time.Hour, 10)))
+	defer c.Close()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		panic("testing")
+	})
+	// the panic is retried at once.
+	id := s.Publish("testing_tube", []byte("testing"))
+	if !s.Wait(time.Second, func() bool { return s.req[id] == time.Hour }) {
+		t.Fatal(s.req)
+	}
+}
+
+func TestConsumerShutdownDialing(t *testing.T) {
+	// a node accepts the connection but never responds.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	c := NewConsumer(ln.Addr().String(), "testing_tube")
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		return nil
+	})
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("not dialed")
+	}
+
+	start := time.Now()
+	c.Pause()
+	c.Resume()
+	ctx, cancel := context.WithTimeout(context.TODO(), 200*time.Millisecond)
+	defer cancel()
+	// the deadline may pass in the dialing, but there is no running job.
+	if err := c.Shutdown(ctx); err != nil {
+		if sErr, ok := err.(*ShutdownError); !ok || len(sErr.Running) > 0 {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("blocked by the dialing", time.Since(start))
+	}
+}
+
+func TestConsumerReserveContext(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	c := NewConsumer(s.Addr(), "testing_tube")
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.TODO())
+	started := make(chan bool, 1)
+	canceled := make(chan error, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- c.ReserveContext(ctx, time.Minute, func(ctx context.Context, job *Job, tried int) error {
+			started <- true
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return Retry(ctx.Err())
+		})
+	}()
+	s.Publish("testing_tube", []byte("testing"))
+	<-started
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not returned")
+	}
+	if err := <-canceled; err != context.Canceled {
+		t.Fatal(err)
+	}
+	// the worker of the canceled ctx is removed.
+	cw := c.(*consumer)
+	cw.workerMu.Lock()
+	workers := len(cw.workers)
+	cw.workerMu.Unlock()
+	if workers != 0 {
+		t.Fatal(workers)
+	}
+
+	go func() {
+		result <- c.ReserveContext(context.TODO(), time.Minute, func(ctx context.Context, job *Job, tried int) error {
+			return nil
+		})
+	}()
+	// ReserveHandler returns nil on the normal close.
+	handlerResult := make(chan error, 1)
+	go func() {
+		handlerResult <- c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+			return nil
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	c.Close()
+	if err := <-result; err != ErrConsumerClosed {
+		t.Fatal(err)
+	}
+	if err := <-handlerResult; err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReserveContext(context.TODO(), time.Minute, nil); err != ErrConsumerClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumerObserver(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	events := make(chan *Event, 10)
+	c := NewConsumer(s.Addr(), "testing_tube", WithObserver(ObserverFunc(func(e *Event) {
+		if e.Type == EventFinished || e.Type == EventRequeued {
+			events <- e
+		}
+	})))
+	defer c.Close()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		if string(job.Body) == "retry" {
+			return RetryAfter(time.Hour, nil)
+		}
+		return nil
+	})
+	finID := s.Publish("testing_tube", []byte("testing"))
+	reqID := s.Publish("testing_tube", []byte("retry"))
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			if e.Addr != s.Addr() || e.Name != "consumer" {
+				t.Fatal(e)
+			}
+			if (e.Type == EventFinished && e.MessageID != finID) || (e.Type == EventRequeued && e.MessageID != reqID) {
+				t.Fatal(e)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+	}
+}
+
+func TestConsumerTimeout(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	m := NewMetrics()
+	c := NewConsumer(s.Addr(), "testing_tube", WithMetrics(m), WithTimeoutDelay(time.Hour))
+	defer c.Close()
+	release := make(chan bool)
+	go c.ReserveHandler(100*time.Millisecond, func(ctx context.Context, job *Job, tried int) error {
+		if string(job.Body) == "slow" {
+			<-ctx.Done()
+			<-release
+		}
+		return nil
+	})
+	slowID := s.Publish("testing_tube", []byte("slow"))
+	fastID := s.Publish("testing_tube", []byte("fast"))
+
+	// only the slow job is requeued, and the worker goes on without stall.
+	if !s.Wait(time.Second, func() bool { return len(s.fin) == 1 && s.fin[0] == fastID }) {
+		t.Fatal("fast job is stalled")
+	}
+	if !s.Wait(time.Second, func() bool { return s.req[slowID] == time.Hour }) {
+		t.Fatal("slow job is not requeued")
+	}
+
+	// the late result is ignored.
+	close(release)
+	time.Sleep(100 * time.Millisecond)
+	s.mu.Lock()
+	fin := len(s.fin)
+	s.mu.Unlock()
+	if fin != 1 {
+		t.Fatal(fin)
+	}
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf)
+	for _, line := range []string{
+		`nsq_consumer_timeouts_total{topic="testing_tube",channel="default"} 1`,
+		`nsq_consumer_late_results_total{topic="testing_tube",channel="default"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatal(line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gwaylib/errors"
+)
+
+// DeadLetter is published to the dead-letter topic when a job exhausts its retries.
+type DeadLetter struct {
+	// source topic of the job
+	Topic string `json:"topic"`
+	// failed deliveries of the job
+	Attempts int `json:"attempts"`
+	// error of the last handling
+	LastError string `json:"last_error"`
+	// the job was published at FirstSeen and given up at LastSeen
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// headers of the envelope
+	Headers map[string]string `json:"headers,omitempty"`
+	// original data of the job
+	Body []byte `json:"body"`
+}
+
+// Encode returns the data which is published to the dead-letter topic.
+func (d *DeadLetter) Encode() ([]byte, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, errors.As(err)
+	}
+	return data, nil
+}
+
+// DecodeDeadLetter decodes the data read from a dead-letter topic.
+func DecodeDeadLetter(data []byte) (*DeadLetter, error) {
+	d := &DeadLetter{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, errors.As(err)
+	}
+	return d, nil
+}
+
+// WithDeadLetter publishes the jobs which exhaust their retries to the topic of p instead of deleting them.
+func WithDeadLetter(p Producer) ConsumerOption {
+	return func(c *consumer) {
+		c.deadLetter = p
+	}
+}
+
+// NewRedriveHandler returns a handler for the consumer of a dead-letter topic,
+// it puts the original data back to the source topic by p, or the topic of p if the source is unknown.
+// The data which is not a dead letter is dropped, and a failed put is retried by the RetryPolicy of the consumer,
+// both are logged by the logger of the consumer.
+//
+// 例子
+//
+// c := NewConsumer(addr, "pay_dead")
+// go c.ReserveHandler(time.Minute, NewRedriveHandler(NewProducer(1, addr, "pay")))
+func NewRedriveHandler(p Producer) Handler {
+	return func(ctx context.Context, job *Job, tried int) error {
+		d, err := DecodeDeadLetter(job.Body)
+		if err != nil {
+			// not a dead letter, retrying can't fix it.
+			return Drop(err)
+		}
+		put := p.Put
+		if len(d.Headers) > 0 {
+			put = func(data []byte) error {
+				return p.PutHeaders(d.Topic, data, d.Headers)
+			}
+		} else if len(d.Topic) > 0 {
+			put = func(data []byte) error {
+				return p.PutTopic(d.Topic, data)
+			}
+		}
+		if err := put(d.Body); err != nil {
+			return errors.As(err, d.Topic)
+		}
+		return nil
+	}
+}
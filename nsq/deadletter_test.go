@@ -0,0 +1,90 @@
+package nsq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testProducer struct {
+	data   [][]byte
+	topics []string
+}
+
+func (p *testProducer) Put(data []byte) error {
+	p.data = append(p.data, data)
+	return nil
+}
+
+func (p *testProducer) PutMany(data [][]byte) error {
+	p.data = append(p.data, data...)
+	return nil
+}
+
+func (p *testProducer) PutDelay(data []byte, delay time.Duration) error {
+	return p.Put(data)
+}
+
+func (p *testProducer) PutTopic(topic string, data []byte) error {
+	p.topics = append(p.topics, topic)
+	return p.Put(data)
+}
+
+func (p *testProducer) PutManyTopic(topic string, data [][]byte) error {
+	p.topics = append(p.topics, topic)
+	return p.PutMany(data)
+}
+
+func (p *testProducer) PutDelayTopic(topic string, data []byte, delay time.Duration) error {
+	p.topics = append(p.topics, topic)
+	return p.PutDelay(data, delay)
+}
+
+func (p *testProducer) PutHeaders(topic string, data []byte, headers map[string]string) error {
+	p.topics = append(p.topics, topic)
+	return p.Put(data)
+}
+
+func (p *testProducer) Close() error {
+	return nil
+}
+
+func TestDeadLetter(t *testing.T) {
+	d := &DeadLetter{
+		Topic:     "testing_tube",
+		Attempts:  78,
+		LastError: "handle failed",
+		FirstSeen: time.Now().Add(-time.Hour).UTC(),
+		LastSeen:  time.Now().UTC(),
+		Body:      []byte("testing"),
+	}
+	data, err := d.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := DecodeDeadLetter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Topic != d.Topic || out.Attempts != d.Attempts || out.LastError != d.LastError ||
+		!out.FirstSeen.Equal(d.FirstSeen) || !out.LastSeen.Equal(d.LastSeen) || string(out.Body) != string(d.Body) {
+		t.Fatal(out)
+	}
+
+	p := &testProducer{}
+	handle := NewRedriveHandler(p)
+	if err := handle(context.TODO(), &Job{Body: data}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.data) != 1 || string(p.data[0]) != "testing" {
+		t.Fatal(p.data)
+	}
+	// put back to the source topic.
+	if len(p.topics) != 1 || p.topics[0] != "testing_tube" {
+		t.Fatal(p.topics)
+	}
+	// the raw data is dropped rather than retried.
+	if o := outcomeOf(handle(context.TODO(), &Job{Body: []byte("testing")}, 0)); o.Action != ActionDrop {
+		t.Fatal(o)
+	}
+}
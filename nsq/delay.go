@@ -0,0 +1,155 @@
+package nsq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/gwaylib/errors"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// the max-req-timeout of nsqd
+const defaultMaxReqTimeout = time.Hour
+
+// ErrInvalidDelay the delay is negative or out of the range of nsqd.
+var ErrInvalidDelay = errors.New("invalid delay")
+
+// WithMaxReqTimeout sets the max delay of DPUB which is the max-req-timeout of nsqd, default is 1 hour.
+// The longer delays of PutDelay are re-deferred by the consumer, see PutDelay.
+func WithMaxReqTimeout(timeout time.Duration) ProducerOption {
+	return func(p *producer) {
+		if timeout > 0 {
+			p.maxReqTimeout = timeout
+		}
+	}
+}
+
+// deferral is the header of the message which is delayed longer than the max-req-timeout,
+// the message is published with the rest of the delay, then requeued by the consumer by the step until the due time.
+//
+// [4-byte magic][8-byte due time in unix ms][8-byte step in ms][4-byte hops][body]
+//
+// hops is the requeues expected before the due time, they're not counted as tried.
+var deferralMagic = []byte{0, 'D', 'L', 'Y'}
+
+const deferralHeaderSize = 24
+
+func encodeDeferral(due time.Time, step time.Duration, hops int, body []byte) []byte {
+	buf := make([]byte, deferralHeaderSize+len(body))
+	copy(buf, deferralMagic)
+	// round up, it's not delivered before the due time.
+	ms := (due.UnixNano() + int64(time.Millisecond) - 1) / int64(time.Millisecond)
+	binary.BigEndian.PutUint64(buf[4:], uint64(ms))
+	binary.BigEndian.PutUint64(buf[12:], uint64(step/time.Millisecond))
+	binary.BigEndian.PutUint32(buf[20:], uint32(hops))
+	copy(buf[deferralHeaderSize:], body)
+	return buf
+}
+
+// decodeDeferral returns false if the body has no deferral header.
+func decodeDeferral(data []byte) (due time.Time, step time.Duration, hops int, body []byte, ok bool) {
+	if len(data) < deferralHeaderSize || !bytes.Equal(data[:4], deferralMagic) {
+		return time.Time{}, 0, 0, data, false
+	}
+	due = time.Unix(0, int64(binary.BigEndian.Uint64(data[4:]))*int64(time.Millisecond))
+	step = time.Duration(binary.BigEndian.Uint64(data[12:])) * time.Millisecond
+	hops = int(binary.BigEndian.Uint32(data[20:]))
+	return due, step, hops, data[deferralHeaderSize:], true
+}
+
+// PutDelay publishes the message by DPUB which is delivered after the delay.
+// If the delay is longer than the max-req-timeout, the message is requeued by the consumer until the due time
+// by the clock of the consumer, the handler sees it once, and the requeues are not counted as tried
+// except the extra ones caused by the early redelivery of nsqd, e.g. the consumer disconnected.
+func (p *producer) PutDelay(data []byte, delay time.Duration) error {
+	return p.PutDelayTopic(p.tube, data, delay)
+}
+
+func (p *producer) PutDelayTopic(topic string, data []byte, delay time.Duration) error {
+	p.poolSync.Lock()
+	if p.isClosed {
+		p.poolSync.Unlock()
+		return errors.New("producer has closed")
+	}
+	p.poolSync.Unlock()
+
+	if _, err := p.hops(delay); err != nil {
+		return err
+	}
+	if p.envelope {
+		wrapped, err := p.wrap(data, nil)
+		if err != nil {
+			return err
+		}
+		data = wrapped
+	}
+	return p.send(&spoolRecord{topic: topic, data: [][]byte{data}, delay: delay})
+}
+
+// hops returns the requeues of the delay by the consumer.
+func (p *producer) hops(delay time.Duration) (int, error) {
+	if delay < 0 {
+		return 0, ErrInvalidDelay.As(delay)
+	}
+	if delay <= p.maxReqTimeout {
+		return 0, nil
+	}
+	// the first delay is in (0, step].
+	hops := int((delay - 1) / p.maxReqTimeout)
+	if hops > 0xfffe {
+		// the attempts of nsqd is uint16
+		return 0, ErrInvalidDelay.As(delay, p.maxReqTimeout)
+	}
+	return hops, nil
+}
+
+func (p *producer) putDelay(topic string, data []byte, delay time.Duration) error {
+	hops, err := p.hops(delay)
+	if err != nil {
+		return err
+	}
+	if delay == 0 {
+		return p.putMany(topic, [][]byte{data})
+	}
+	if hops > 0 {
+		data = encodeDeferral(time.Now().Add(delay), p.maxReqTimeout, hops, data)
+		delay -= time.Duration(hops) * p.maxReqTimeout
+	}
+	return p.do(topic, 1, func(c *conn) error {
+		return c.putDelay(topic, data, delay)
+	})
+}
+
+func (p *conn) putDelay(topic string, data []byte, delay time.Duration) error {
+	if p.isClosed() {
+		return ErrClosed
+	}
+
+	if err := p.connect(); err != nil {
+		p.reset()
+		return errors.As(err)
+	}
+
+	return p.publish(nsq.DeferredPublish(topic, delay, data))
+}
+
+// deferred requeues the job by the step until the due time of PutDelay,
+// a redelivery doesn't shorten the delay. The header is removed from the body when the due time passed.
+func (c *worker) deferred(job *Job) bool {
+	due, step, hops, body, ok := decodeDeferral(job.Body)
+	if !ok {
+		return false
+	}
+	if rest := time.Until(due); rest > 0 && job.msg != nil {
+		if rest > step {
+			rest = step
+		}
+		// REQ is in ms, don't deliver it before the due time.
+		job.msg.RequeueWithoutBackoff((rest + time.Millisecond - 1).Truncate(time.Millisecond))
+		return true
+	}
+	job.Body = body
+	job.deferrals = hops
+	return false
+}
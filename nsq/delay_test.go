@@ -0,0 +1,139 @@
+package nsq
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestDeferral(t *testing.T) {
+	due := time.Unix(1700000000, 123*int64(time.Millisecond))
+	data := encodeDeferral(due, time.Hour, 3, []byte("testing"))
+	out, step, hops, body, ok := decodeDeferral(data)
+	if !ok || !out.Equal(due) || step != time.Hour || hops != 3 || string(body) != "testing" {
+		t.Fatal(out, step, hops, string(body), ok)
+	}
+	if _, _, _, body, ok := decodeDeferral([]byte("testing")); ok || string(body) != "testing" {
+		t.Fatal(string(body), ok)
+	}
+}
+
+type testMessageDelegate struct {
+	requeued []time.Duration
+}
+
+func (d *testMessageDelegate) OnFinish(m *nsq.Message) {}
+
+func (d *testMessageDelegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.requeued = append(d.requeued, delay)
+}
+
+func (d *testMessageDelegate) OnTouch(m *nsq.Message) {}
+
+func TestWorkerDeferred(t *testing.T) {
+	w := &worker{}
+	d := &testMessageDelegate{}
+	newJob := func(due time.Time, attempts uint16) *Job {
+		msg := nsq.NewMessage(nsq.MessageID{}, encodeDeferral(due, 100*time.Millisecond, 2, []byte("testing")))
+		msg.Attempts = attempts
+		msg.Delegate = d
+		return &Job{Body: msg.Body, msg: msg}
+	}
+
+	// a redelivery beyond the hops still waits for the due time by the step.
+	if job := newJob(time.Now().Add(time.Second), 5); !w.deferred(job) {
+		t.Fatal("expect deferred")
+	}
+	// the rest of the delay is less than the step.
+	if job := newJob(time.Now().Add(50*time.Millisecond), 2); !w.deferred(job) {
+		t.Fatal("expect deferred")
+	}
+	// the due time and REQ are rounded up to ms.
+	if len(d.requeued) != 2 || d.requeued[0] != 100*time.Millisecond ||
+		d.requeued[1] <= 0 || d.requeued[1] > 51*time.Millisecond {
+		t.Fatal(d.requeued)
+	}
+
+	job := newJob(time.Now().Add(-time.Millisecond), 3)
+	if w.deferred(job) {
+		t.Fatal("expect due")
+	}
+	if string(job.Body) != "testing" || job.deferrals != 2 || job.tried() != 0 {
+		t.Fatal(string(job.Body), job.deferrals, job.tried())
+	}
+}
+
+func TestProducerPutDelay(t *testing.T) {
+	s := newTestNsqd(t, func(s *testNsqd) {
+		s.maxReqTimeout = time.Second
+	})
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube", WithMaxReqTimeout(time.Second))
+	defer p.Close()
+	if err := p.PutDelay([]byte("testing"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PutDelay([]byte("testing"), -time.Second); !ErrInvalidDelay.Equal(err) {
+		t.Fatal(err)
+	}
+	if !s.Wait(time.Second, func() bool { return len(s.pub["testing_tube"]) == 1 }) {
+		t.Fatal("not published")
+	}
+	if !s.Wait(0, func() bool { return len(s.dpub) == 1 && s.dpub[0] == 50*time.Millisecond }) {
+		t.Fatal(s.dpub)
+	}
+
+	// the max-req-timeout of nsqd is less than the producer's.
+	bad := NewProducer(1, s.Addr(), "testing_tube", WithMaxReqTimeout(time.Hour))
+	defer bad.Close()
+	if err := bad.PutDelay([]byte("testing"), time.Minute); !ErrInvalidDelay.Equal(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumerDeferral(t *testing.T) {
+	s := newTestNsqd(t, func(s *testNsqd) {
+		s.maxReqTimeout = 100 * time.Millisecond
+		s.deferReq = true
+	})
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube", WithMaxReqTimeout(100*time.Millisecond))
+	defer p.Close()
+	start := time.Now()
+	if err := p.PutDelay([]byte("testing"), 250*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// 50ms by DPUB, then 100ms twice by REQ.
+	if !s.Wait(0, func() bool { return len(s.dpub) == 1 && s.dpub[0] == 50*time.Millisecond }) {
+		t.Fatal(s.dpub)
+	}
+
+	c := NewConsumer(s.Addr(), "testing_tube")
+	defer c.Close()
+	type result struct {
+		body    []byte
+		tried   int
+		elapsed time.Duration
+	}
+	received := make(chan result, 1)
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		received <- result{job.Body, tried, time.Since(start)}
+		return nil
+	})
+	select {
+	case r := <-received:
+		if !bytes.Equal(r.body, []byte("testing")) || r.tried != 0 || r.elapsed < 250*time.Millisecond {
+			t.Fatal(string(r.body), r.tried, r.elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not received")
+	}
+	if !s.Wait(time.Second, func() bool { return len(s.req) == 1 && len(s.fin) == 1 }) {
+		t.Fatal(s.req, s.fin)
+	}
+}
@@ -1,13 +1,20 @@
 package nsq
 
 import (
-	"fmt"
+	"os"
+	"sync"
 
+	"github.com/gwaylib/errors"
+	"github.com/gwaylib/log/logger"
+	"github.com/gwaylib/log/logger/adapter/stdio"
+	"github.com/gwaylib/log/logger/proto"
 	nsq "github.com/nsqio/go-nsq"
 )
 
 type Delegate struct {
 	name     string
+	log      proto.Logger
+	observer Observer
 	resp     chan []byte
 	err      chan []byte
 	msg      chan *nsq.Message
@@ -16,87 +23,156 @@ type Delegate struct {
 	backoff  chan bool
 	goOn     chan bool
 	resume   chan bool
-	ioErr    chan error
+	ioErr    chan *ioError
 	hearbeat chan bool
-	close    chan bool
+	close    chan *nsq.Conn
+
+	stopOnce sync.Once
+	stopped  chan bool
+}
+
+// ioError is the transport error of a connection.
+type ioError struct {
+	conn *nsq.Conn
+	err  error
 }
 
 func NewDelegate(name string) *Delegate {
 	return &Delegate{
 		name:     name,
+		log:      logger.New(name, stdio.New(os.Stderr)),
 		resp:     make(chan []byte, 1),
 		err:      make(chan []byte, 1),
-		msg:      make(chan *nsq.Message, 1),
+		msg:      make(chan *nsq.Message),
 		finished: make(chan *nsq.Message, 1),
 		requeue:  make(chan *nsq.Message, 1),
-		backoff:  make(chan bool, 1),
-		goOn:     make(chan bool, 1),
-		resume:   make(chan bool, 1),
-		ioErr:    make(chan error, 1),
+		backoff:  make(chan bool, 64),
+		goOn:     make(chan bool, 64),
+		resume:   make(chan bool, 64),
+		ioErr:    make(chan *ioError, 1),
 		hearbeat: make(chan bool, 1),
-		close:    make(chan bool, 1),
+		close:    make(chan *nsq.Conn, 16),
+		stopped:  make(chan bool),
 	}
 }
 
+// emit sends the event to the observer
+func (d *Delegate) emit(t EventType, conn *nsq.Conn, err error, msg *nsq.Message) {
+	if d.observer == nil {
+		return
+	}
+	e := &Event{Type: t, Name: d.name, Addr: conn.String(), Err: err}
+	if msg != nil {
+		e.MessageID = msg.ID
+	}
+	d.observer.OnEvent(e)
+}
+
 // OnResponse is called when the connection
 // receives a FrameTypeResponse from nsqd
 func (d *Delegate) OnResponse(conn *nsq.Conn, data []byte) {
-	// fmt.Println(d.name + " on response:" + string(data))
+	select {
+	case d.resp <- data:
+	default:
+		// nobody is waiting for the response.
+	}
 }
 
 // OnError is called when the connection
 // receives a FrameTypeError from nsqd
 func (d *Delegate) OnError(conn *nsq.Conn, data []byte) {
-	fmt.Println(d.name + " on error:" + string(data))
+	err := errors.New(string(data))
+	d.log.Warn(errors.As(err, d.name, conn.String()))
+	d.emit(EventError, conn, err, nil)
+	select {
+	case d.err <- data:
+	default:
+	}
 }
 
 // OnMessage is called when the connection
 // receives a FrameTypeMessage from nsqd
 func (d *Delegate) OnMessage(conn *nsq.Conn, msg *nsq.Message) {
-	d.msg <- msg
+	select {
+	case d.msg <- msg:
+	case <-d.stopped:
+		// nobody takes the message, give it back to nsqd.
+		msg.RequeueWithoutBackoff(0)
+	}
+}
+
+// signal sends the backoff signal to the consumer.
+func (d *Delegate) signal(ch chan bool) {
+	select {
+	case ch <- true:
+	default:
+		// nobody is watching the backoff.
+	}
+}
+
+// stop requeues the messages received after stopping.
+func (d *Delegate) stop() {
+	d.stopOnce.Do(func() {
+		close(d.stopped)
+	})
 }
 
 // OnMessageFinished is called when the connection
 // handles a FIN command from a message handler
 func (d *Delegate) OnMessageFinished(conn *nsq.Conn, msg *nsq.Message) {
-	fmt.Printf("%s on msg finished:%+v\n", d.name, *msg)
+	d.emit(EventFinished, conn, nil, msg)
 }
 
 // OnMessageRequeued is called when the connection
 // handles a REQ command from a message handler
 func (d *Delegate) OnMessageRequeued(conn *nsq.Conn, msg *nsq.Message) {
-	fmt.Printf("%s on msg requeue:%+v\n", d.name, *msg)
+	d.emit(EventRequeued, conn, nil, msg)
 }
 
 // OnBackoff is called when the connection triggers a backoff state
-func (d *Delegate) OnBackoff(*nsq.Conn) {
-	fmt.Println(d.name + " on backoff")
+func (d *Delegate) OnBackoff(conn *nsq.Conn) {
+	d.emit(EventBackoff, conn, nil, nil)
+	d.signal(d.backoff)
 }
 
 // OnContinue is called when the connection finishes a message without adjusting backoff state
-func (d *Delegate) OnContinue(*nsq.Conn) {
-	fmt.Println(d.name + " on continue")
+func (d *Delegate) OnContinue(conn *nsq.Conn) {
+	d.emit(EventContinue, conn, nil, nil)
+	d.signal(d.goOn)
 }
 
 // OnResume is called when the connection triggers a resume state
-func (d *Delegate) OnResume(*nsq.Conn) {
-	fmt.Println("on resume")
+func (d *Delegate) OnResume(conn *nsq.Conn) {
+	d.emit(EventResume, conn, nil, nil)
+	d.signal(d.resume)
 }
 
 // OnIOError is called when the connection experiences
 // a low-level TCP transport error
 func (d *Delegate) OnIOError(conn *nsq.Conn, err error) {
-	fmt.Println(d.name + " OnIOError:" + err.Error())
+	d.log.Warn(errors.As(err, d.name, conn.String()))
+	d.emit(EventIOError, conn, err, nil)
+	select {
+	case d.ioErr <- &ioError{conn: conn, err: err}:
+	default:
+	}
+	// close the broken connection, it will be reconnected after OnClose.
+	conn.Close()
 }
 
 // OnHeartbeat is called when the connection
 // receives a heartbeat from nsqd
-func (d *Delegate) OnHeartbeat(*nsq.Conn) {
-	fmt.Println(d.name + " on heart beat ")
+func (d *Delegate) OnHeartbeat(conn *nsq.Conn) {
+	d.emit(EventHeartbeat, conn, nil, nil)
 }
 
 // OnClose is called when the connection
 // closes, after all cleanup
-func (d *Delegate) OnClose(*nsq.Conn) {
-	fmt.Println(d.name + " on close")
+func (d *Delegate) OnClose(conn *nsq.Conn) {
+	d.emit(EventClose, conn, nil, nil)
+	select {
+	case d.close <- conn:
+	default:
+		// nobody is watching the connections.
+	}
 }
@@ -0,0 +1,165 @@
+package nsq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/gwaylib/errors"
+)
+
+// the envelope is
+// [4-byte magic][1-byte version][8-byte timestamp][2-byte source size][source]
+// [2-byte header count]([2-byte key size][key][4-byte value size][value])...[body]
+var envelopeMagic = []byte{0, 'E', 'N', 'V'}
+
+const (
+	envelopeVersion = 1
+	// magic, version, timestamp, source size and header count
+	envelopeHeadSize = 4 + 1 + 8 + 2 + 2
+)
+
+// ErrNoEnvelope the data is a raw body without envelope.
+var ErrNoEnvelope = errors.New("no envelope")
+
+// Envelope is the versioned binary format which wraps the body with the headers,
+// it's decoded by the consumer into the fields of Job.
+type Envelope struct {
+	// trace id, content type, schema version and so on
+	Headers map[string]string
+	// the time of the put
+	Timestamp time.Time
+	// name of the producer
+	Source string
+	Body   []byte
+}
+
+// Encode returns the data of the envelope, the headers are encoded in order of the keys.
+func (e *Envelope) Encode() ([]byte, error) {
+	if len(e.Source) > 0xffff || len(e.Headers) > 0xffff {
+		return nil, errors.New("envelope too big").As(len(e.Source), len(e.Headers))
+	}
+	keys := make([]string, 0, len(e.Headers))
+	size := envelopeHeadSize + len(e.Source) + len(e.Body)
+	for k, v := range e.Headers {
+		if len(k) > 0xffff {
+			return nil, errors.New("envelope header too big").As(len(k))
+		}
+		keys = append(keys, k)
+		size += 2 + len(k) + 4 + len(v)
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, size)
+	copy(buf, envelopeMagic)
+	buf[4] = envelopeVersion
+	var ts int64
+	if !e.Timestamp.IsZero() {
+		ts = e.Timestamp.UnixNano()
+	}
+	binary.BigEndian.PutUint64(buf[5:], uint64(ts))
+	binary.BigEndian.PutUint16(buf[13:], uint16(len(e.Source)))
+	off := 15 + copy(buf[15:], e.Source)
+	binary.BigEndian.PutUint16(buf[off:], uint16(len(keys)))
+	off += 2
+	for _, k := range keys {
+		v := e.Headers[k]
+		binary.BigEndian.PutUint16(buf[off:], uint16(len(k)))
+		off += 2 + copy(buf[off+2:], k)
+		binary.BigEndian.PutUint32(buf[off:], uint32(len(v)))
+		off += 4 + copy(buf[off+4:], v)
+	}
+	copy(buf[off:], e.Body)
+	return buf, nil
+}
+
+// DecodeEnvelope decodes the data, ErrNoEnvelope is returned if it's a raw body.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	if len(data) < envelopeHeadSize || !bytes.Equal(data[:4], envelopeMagic) {
+		return nil, ErrNoEnvelope
+	}
+	if data[4] != envelopeVersion {
+		return nil, errors.New("unknown envelope version").As(data[4])
+	}
+	e := &Envelope{}
+	if ts := int64(binary.BigEndian.Uint64(data[5:])); ts != 0 {
+		e.Timestamp = time.Unix(0, ts)
+	}
+	off := 15 + int(binary.BigEndian.Uint16(data[13:]))
+	if len(data) < off+2 {
+		return nil, errors.New("invalid envelope")
+	}
+	e.Source = string(data[15:off])
+	count := int(binary.BigEndian.Uint16(data[off:]))
+	off += 2
+	if count > 0 {
+		e.Headers = make(map[string]string, count)
+	}
+	for i := 0; i < count; i++ {
+		if len(data) < off+2 {
+			return nil, errors.New("invalid envelope")
+		}
+		kn := int(binary.BigEndian.Uint16(data[off:]))
+		off += 2
+		if len(data) < off+kn+4 {
+			return nil, errors.New("invalid envelope")
+		}
+		k := string(data[off : off+kn])
+		off += kn
+		vn := int(binary.BigEndian.Uint32(data[off:]))
+		off += 4
+		if len(data) < off+vn {
+			return nil, errors.New("invalid envelope")
+		}
+		e.Headers[k] = string(data[off : off+vn])
+		off += vn
+	}
+	e.Body = data[off:]
+	return e, nil
+}
+
+// WithEnvelope wraps the messages of the producer in the envelope with the source name and the put time,
+// see PutHeaders for the headers.
+func WithEnvelope(source string) ProducerOption {
+	return func(p *producer) {
+		p.envelope = true
+		p.source = source
+	}
+}
+
+// PutHeaders publishes the data in the envelope with the headers,
+// the topic is the one of NewProducer if it's empty.
+func (p *producer) PutHeaders(topic string, data []byte, headers map[string]string) error {
+	if len(topic) == 0 {
+		topic = p.tube
+	}
+	data, err := p.wrap(data, headers)
+	if err != nil {
+		return err
+	}
+	return p.putTopic(topic, data)
+}
+
+func (p *producer) wrap(data []byte, headers map[string]string) ([]byte, error) {
+	e := &Envelope{Headers: headers, Timestamp: time.Now(), Source: p.source, Body: data}
+	return e.Encode()
+}
+
+// unwrap fills the job by the envelope, the raw body is kept.
+func (job *Job) unwrap() {
+	if job.msg != nil {
+		job.Timestamp = time.Unix(0, job.msg.Timestamp)
+	}
+	job.Attempts = job.tried() + 1
+	e, err := DecodeEnvelope(job.Body)
+	if err != nil {
+		return
+	}
+	job.Headers = e.Headers
+	job.Source = e.Source
+	if !e.Timestamp.IsZero() {
+		job.Timestamp = e.Timestamp
+	}
+	job.Body = e.Body
+}
@@ -0,0 +1,79 @@
+package nsq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	e := &Envelope{
+		Headers:   map[string]string{"trace_id": "abc", "content_type": "application/json"},
+		Timestamp: time.Now(),
+		Source:    "testing",
+		Body:      []byte(`{"name":"testing"}`),
+	}
+	data, err := e.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := DecodeEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Headers) != 2 || out.Headers["trace_id"] != "abc" || out.Source != e.Source ||
+		!out.Timestamp.Equal(e.Timestamp) || string(out.Body) != string(e.Body) {
+		t.Fatal(out)
+	}
+
+	if _, err := DecodeEnvelope([]byte("testing")); !ErrNoEnvelope.Equal(err) {
+		t.Fatal(err)
+	}
+	if _, err := DecodeEnvelope(data[:20]); err == nil || ErrNoEnvelope.Equal(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumerEnvelope(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube", WithEnvelope("testing_service"))
+	defer p.Close()
+	if err := p.PutHeaders("", []byte("with headers"), map[string]string{"trace_id": "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put([]byte("with source")); err != nil {
+		t.Fatal(err)
+	}
+	legacy := NewProducer(1, s.Addr(), "testing_tube")
+	defer legacy.Close()
+	if err := legacy.Put([]byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConsumer(s.Addr(), "testing_tube", WithConcurrency(1))
+	defer c.Close()
+	received := make(chan *Job, 3)
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		received <- job
+		return nil
+	})
+	for _, expect := range []struct {
+		body, trace, source string
+	}{
+		{"with headers", "abc", "testing_service"},
+		{"with source", "", "testing_service"},
+		{"raw", "", ""},
+	} {
+		select {
+		case job := <-received:
+			if string(job.Body) != expect.body || job.Headers["trace_id"] != expect.trace || job.Source != expect.source ||
+				job.Attempts != 1 || time.Since(job.Timestamp) > time.Minute {
+				t.Fatal(job)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("not received")
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package nsq
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gwaylib/errors"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// Strategy selects the nsqd node of a put when the producer has several nodes.
+type Strategy int
+
+const (
+	// the healthy nodes are used in turn
+	StrategyRoundRobin Strategy = iota
+	// the first healthy node in order of the addresses is used, the others are secondaries
+	StrategyPrimary
+	// the healthy node with the least put latency is used
+	StrategyLeastLatency
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case StrategyRoundRobin:
+		return "round_robin"
+	case StrategyPrimary:
+		return "primary"
+	case StrategyLeastLatency:
+		return "least_latency"
+	}
+	return "unknown"
+}
+
+const (
+	defaultMaxFails      = 3
+	defaultProbeInterval = 5 * time.Second
+)
+
+// WithProducerNodes adds the nsqd tcp addresses of the producer, a put fails over to the next node
+// when the connection of a node is failed, see WithStrategy and WithHealthCheck.
+func WithProducerNodes(addrs ...string) ProducerOption {
+	return func(p *producer) {
+		p.addrs = append(p.addrs, addrs...)
+	}
+}
+
+// WithStrategy sets the selection strategy of the nodes, default is StrategyRoundRobin.
+func WithStrategy(s Strategy) ProducerOption {
+	return func(p *producer) {
+		p.strategy = s
+	}
+}
+
+// WithHealthCheck marks a node unhealthy after fails consecutive connection errors, default is 3,
+// and probes it by the interval until it's connected, default is 5 seconds.
+// The unhealthy nodes are tried only when the healthy ones failed.
+func WithHealthCheck(fails int, interval time.Duration) ProducerOption {
+	return func(p *producer) {
+		if fails > 0 {
+			p.maxFails = fails
+		}
+		if interval > 0 {
+			p.probeInterval = interval
+		}
+	}
+}
+
+// NewFailoverProducer create a Producer of several nsqd nodes, see WithProducerNodes.
+func NewFailoverProducer(size int, addrs []string, tube string, opts ...ProducerOption) Producer {
+	return NewProducer(size, "", tube, append([]ProducerOption{WithProducerNodes(addrs...)}, opts...)...)
+}
+
+// node is a nsqd of the producer, the connections of it are pooled.
+type node struct {
+	addr string
+	pool sync.Pool
+
+	mu      sync.Mutex
+	conns   int
+	healthy bool
+	fails   int
+	// moving average of the put latency, 0 is unknown.
+	latency time.Duration
+}
+
+func newNode(p *producer, addr string) *node {
+	nd := &node{addr: addr, healthy: true}
+	nd.pool.New = func() interface{} {
+		nd.mu.Lock()
+		defer nd.mu.Unlock()
+		nd.conns += 1
+		return newConn(p, addr)
+	}
+	return nd
+}
+
+// do publishes by a pooled connection.
+func (nd *node) do(fn func(c *conn) error) error {
+	conn := nd.pool.Get().(*conn)
+	defer nd.pool.Put(conn)
+	return fn(conn)
+}
+
+func (nd *node) isHealthy() bool {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	return nd.healthy
+}
+
+// close closes the connections, the node must not be used after.
+func (nd *node) close() {
+	nd.mu.Lock()
+	n := nd.conns
+	nd.mu.Unlock()
+	for i := n; i > 0; i-- {
+		conn := nd.pool.Get().(*conn)
+		conn.disconn()
+	}
+}
+
+// isNodeErr returns true if the error is caused by the node, then the put can be tried on the next node.
+func isNodeErr(err error) bool {
+	return ErrConnect.Equal(err) || ErrConnClosed.Equal(err) || ErrPutTimeout.Equal(err) || ErrPutFailed.Equal(err)
+}
+
+// selectNodes returns the healthy nodes ordered by the strategy, then the unhealthy ones.
+func (p *producer) selectNodes() []*node {
+	if len(p.nodes) == 1 {
+		return p.nodes
+	}
+	healthy := make([]*node, 0, len(p.nodes))
+	unhealthy := []*node{}
+	latency := map[*node]time.Duration{}
+	for _, nd := range p.nodes {
+		nd.mu.Lock()
+		if nd.healthy {
+			healthy = append(healthy, nd)
+		} else {
+			unhealthy = append(unhealthy, nd)
+		}
+		latency[nd] = nd.latency
+		nd.mu.Unlock()
+	}
+
+	switch p.strategy {
+	case StrategyRoundRobin:
+		if len(healthy) > 1 {
+			start := int(atomic.AddUint32(&p.next, 1) % uint32(len(healthy)))
+			rotated := make([]*node, 0, len(p.nodes))
+			rotated = append(rotated, healthy[start:]...)
+			healthy = append(rotated, healthy[:start]...)
+		}
+	case StrategyLeastLatency:
+		// the unknown ones are measured at first.
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return latency[healthy[i]] < latency[healthy[j]]
+		})
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (p *producer) nodeSucceed(nd *node, latency time.Duration) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	nd.fails = 0
+	if nd.latency == 0 {
+		nd.latency = latency
+		return
+	}
+	nd.latency = (nd.latency*4 + latency) / 5
+}
+
+// nodeFailed marks the node unhealthy after the max fails, and starts probing it.
+func (p *producer) nodeFailed(nd *node, err error) {
+	nd.mu.Lock()
+	nd.fails++
+	down := nd.healthy && nd.fails >= p.maxFails
+	if down {
+		nd.healthy = false
+	}
+	nd.mu.Unlock()
+	if !down {
+		return
+	}
+
+	p.log.Warn(errors.New("nsqd unhealthy").As(nd.addr, err))
+	p.metrics.Set(metricProducerNodeHealthy, 0, "addr", nd.addr)
+	p.probeWg.Add(1)
+	go p.probe(nd)
+}
+
+// probe connects the unhealthy node by the interval until it's connected or the producer is closed.
+func (p *producer) probe(nd *node) {
+	defer p.probeWg.Done()
+	ticker := time.NewTicker(p.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.sig_exit:
+			return
+		case <-ticker.C:
+		}
+
+		delegate := NewDelegate("producer")
+		delegate.log = p.log
+		delegate.observer = p.observer
+		c, _, err := p.dial(nd.addr, p.newConfig(), delegate, func(conn *nsq.Conn) {
+			conn.SetLogger(&nsqLogger{p.log}, p.logLevel, "")
+		})
+		if err != nil {
+			p.log.Debug(errors.As(err, nd.addr))
+			continue
+		}
+		c.Close()
+
+		nd.mu.Lock()
+		nd.healthy = true
+		nd.fails = 0
+		nd.mu.Unlock()
+		p.log.Info("msq-p healthy:" + nd.addr)
+		p.metrics.Set(metricProducerNodeHealthy, 1, "addr", nd.addr)
+		return
+	}
+}
@@ -0,0 +1,105 @@
+package nsq
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns an address which is not listened.
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestProducerFailover(t *testing.T) {
+	down := freeAddr(t)
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	p := NewFailoverProducer(1, []string{down, s.Addr()}, "testing_tube",
+		WithStrategy(StrategyPrimary), WithHealthCheck(1, 50*time.Millisecond))
+	defer p.Close()
+	primary := p.(*producer).nodes[0]
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Wait(0, func() bool { return len(s.pub["testing_tube"]) == 1 }) {
+		t.Fatal("not failed over")
+	}
+	if primary.isHealthy() {
+		t.Fatal("expect unhealthy")
+	}
+
+	// the primary is back by probing.
+	back := newTestNsqd(t, func(s *testNsqd) {
+		s.listen = down
+	})
+	defer back.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !primary.isHealthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("not probed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if !back.Wait(0, func() bool { return len(back.pub["testing_tube"]) == 1 }) {
+		t.Fatal("not back to primary")
+	}
+
+	// the errors of the message are not failed over.
+	if err := p.PutTopic("a!b", []byte("testing")); !ErrBadTopic.Equal(err) {
+		t.Fatal(err)
+	}
+	if !primary.isHealthy() || !s.Wait(0, func() bool { return len(s.pub["testing_tube"]) == 1 }) {
+		t.Fatal("unexpected failover")
+	}
+
+	// the error of the last node is returned.
+	back.Close()
+	s.Close()
+	if err := p.Put([]byte("testing")); !isNodeErr(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestProducerStrategy(t *testing.T) {
+	s1 := newTestNsqd(t)
+	defer s1.Close()
+	s2 := newTestNsqd(t)
+	defer s2.Close()
+
+	p := NewFailoverProducer(1, []string{s1.Addr(), s2.Addr()}, "testing_tube")
+	for i := 0; i < 4; i++ {
+		if err := p.Put([]byte("testing")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Close()
+	if !s1.Wait(0, func() bool { return len(s1.pub["testing_tube"]) == 2 }) {
+		t.Fatal("not round robin")
+	}
+
+	slow := newTestNsqd(t, func(s *testNsqd) {
+		s.pubDelay = 50 * time.Millisecond
+	})
+	defer slow.Close()
+	p = NewFailoverProducer(1, []string{slow.Addr(), s2.Addr()}, "testing_tube", WithStrategy(StrategyLeastLatency))
+	defer p.Close()
+	for i := 0; i < 10; i++ {
+		if err := p.Put([]byte("testing")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only the first one is put to the slow node for measuring.
+	if !slow.Wait(0, func() bool { return len(slow.pub["testing_tube"]) == 1 }) {
+		t.Fatal("not least latency")
+	}
+}
@@ -0,0 +1,109 @@
+package nsq
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"time"
+
+	"github.com/gwaylib/errors"
+)
+
+// Handler handles the job which is pushed.
+//
+// Return nil to finish the job, or the error made by Retry, RetryAfter, Drop and ToDeadLetter to decide the next step,
+// any other error is retried by the RetryPolicy of the consumer.
+type Handler func(ctx context.Context, job *Job, tried int) error
+
+// Action is what to do with the job after handling.
+type Action int
+
+const (
+	// finish the job
+	ActionAck Action = iota
+	// requeue the job with the RetryPolicy of the consumer
+	ActionRetry
+	// requeue the job after the delay of Outcome
+	ActionRetryAfter
+	// finish the job without retry
+	ActionDrop
+	// send the job to the dead-letter topic
+	ActionDeadLetter
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionAck:
+		return "ack"
+	case ActionRetry:
+		return "retry"
+	case ActionRetryAfter:
+		return "retry_after"
+	case ActionDrop:
+		return "drop"
+	case ActionDeadLetter:
+		return "dead_letter"
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+// Outcome is the error returned by Handler to decide the next step of the job.
+type Outcome struct {
+	Action Action
+	// delay of ActionRetryAfter
+	Delay time.Duration
+	// the reason of the outcome, it's recorded by the dead letter.
+	Err error
+}
+
+func (o *Outcome) Error() string {
+	if o.Err == nil {
+		return o.Action.String()
+	}
+	return o.Action.String() + ":" + o.Err.Error()
+}
+
+// Retry requeues the job with the RetryPolicy of the consumer.
+func Retry(err error) error {
+	return &Outcome{Action: ActionRetry, Err: err}
+}
+
+// RetryAfter requeues the job after the delay.
+func RetryAfter(delay time.Duration, err error) error {
+	return &Outcome{Action: ActionRetryAfter, Delay: delay, Err: err}
+}
+
+// Drop finishes the job without retry.
+func Drop(err error) error {
+	return &Outcome{Action: ActionDrop, Err: err}
+}
+
+// ToDeadLetter sends the job to the dead-letter topic without retry,
+// the job is deleted if the consumer has no dead-letter topic.
+func ToDeadLetter(err error) error {
+	return &Outcome{Action: ActionDeadLetter, Err: err}
+}
+
+// outcomeOf returns the outcome of the error returned by Handler, the outcome may be wrapped by the error.
+func outcomeOf(err error) *Outcome {
+	if err == nil {
+		return &Outcome{Action: ActionAck}
+	}
+	var o *Outcome
+	if stderrors.As(err, &o) {
+		return o
+	}
+	return &Outcome{Action: ActionRetry, Err: err}
+}
+
+var errHandleFailed = errors.New("handle failed")
+
+// Handler adapts the bool handle to Handler, false is retried by the RetryPolicy of the consumer.
+func (h HandleContext) Handler() Handler {
+	return func(ctx context.Context, job *Job, tried int) error {
+		if h(ctx, job, tried) {
+			return nil
+		}
+		return Retry(errHandleFailed)
+	}
+}
@@ -0,0 +1,53 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOutcome(t *testing.T) {
+	cause := errors.New("testing")
+	cases := []struct {
+		err    error
+		action Action
+		delay  time.Duration
+		cause  error
+	}{
+		{nil, ActionAck, 0, nil},
+		{cause, ActionRetry, 0, cause},
+		{Retry(cause), ActionRetry, 0, cause},
+		{RetryAfter(time.Minute, cause), ActionRetryAfter, time.Minute, cause},
+		{Drop(cause), ActionDrop, 0, cause},
+		{ToDeadLetter(cause), ActionDeadLetter, 0, cause},
+		// wrapped by the caller
+		{fmt.Errorf("handle order: %w", Drop(cause)), ActionDrop, 0, cause},
+		{fmt.Errorf("handle order: %w", RetryAfter(time.Second, cause)), ActionRetryAfter, time.Second, cause},
+	}
+	for i, c := range cases {
+		o := outcomeOf(c.err)
+		if o.Action != c.action || o.Delay != c.delay || o.Err != c.cause {
+			t.Fatal(i, o)
+		}
+	}
+	if RetryAfter(time.Minute, cause).Error() != "retry_after:testing" {
+		t.Fatal(RetryAfter(time.Minute, cause).Error())
+	}
+}
+
+func TestHandleContextAdapter(t *testing.T) {
+	ok := HandleContext(func(ctx context.Context, job *Job, tried int) bool {
+		return true
+	}).Handler()
+	if err := ok(context.TODO(), &Job{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	failed := HandleContext(func(ctx context.Context, job *Job, tried int) bool {
+		return false
+	}).Handler()
+	if o := outcomeOf(failed(context.TODO(), &Job{}, 0)); o.Action != ActionRetry || o.Err == nil {
+		t.Fatal(o)
+	}
+}
@@ -0,0 +1,147 @@
+package nsq
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwaylib/errors"
+)
+
+// WithLookupd discovers the nsqd nodes of the topic by the nsqlookupd http addresses,
+// the consumer connects to every node which produces the topic.
+func WithLookupd(addrs ...string) ConsumerOption {
+	return func(c *consumer) {
+		if c.lookupd == nil {
+			c.lookupd = newLookupd()
+		}
+		c.lookupd.addrs = append(c.lookupd.addrs, addrs...)
+	}
+}
+
+// WithLookupdPollInterval sets the interval to poll the nsqlookupd, default is 60 seconds.
+func WithLookupdPollInterval(interval time.Duration) ConsumerOption {
+	return func(c *consumer) {
+		if c.lookupd == nil {
+			c.lookupd = newLookupd()
+		}
+		c.lookupd.interval = interval
+	}
+}
+
+// NewLookupdConsumer create a Consumer which discovers the nsqd nodes by nsqlookupd.
+func NewLookupdConsumer(lookupd []string, tube string, opts ...ConsumerOption) Consumer {
+	return NewConsumer("", tube, append([]ConsumerOption{WithLookupd(lookupd...)}, opts...)...)
+}
+
+type lookupProducer struct {
+	BroadcastAddress string `json:"broadcast_address"`
+	TCPPort          int    `json:"tcp_port"`
+}
+
+type lookupResp struct {
+	Producers []*lookupProducer `json:"producers"`
+
+	// response of the nsqlookupd before v1.0
+	Data struct {
+		Producers []*lookupProducer `json:"producers"`
+	} `json:"data"`
+}
+
+type lookupd struct {
+	addrs    []string
+	interval time.Duration
+	client   *http.Client
+
+	mu       sync.Mutex
+	lastPoll time.Time
+	nodes    []string
+}
+
+func newLookupd() *lookupd {
+	return &lookupd{
+		interval: 60 * time.Second,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Nodes returns the nsqd tcp addresses of the topic,
+// the result is cached in the poll interval and the last result is kept when all of the nsqlookupd failed.
+func (l *lookupd) Nodes(topic string) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.lastPoll.IsZero() && time.Since(l.lastPoll) < l.interval {
+		return l.nodes, nil
+	}
+	l.lastPoll = time.Now()
+
+	nodes := map[string]bool{}
+	var lastErr error
+	succeed := 0
+	for _, addr := range l.addrs {
+		addrs, err := l.lookup(addr, topic)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		succeed++
+		for _, a := range addrs {
+			nodes[a] = true
+		}
+	}
+	if succeed == 0 && lastErr != nil {
+		return l.nodes, errors.As(lastErr)
+	}
+
+	result := make([]string, 0, len(nodes))
+	for a := range nodes {
+		result = append(result, a)
+	}
+	sort.Strings(result)
+	l.nodes = result
+	return result, nil
+}
+
+func (l *lookupd) lookup(addr, topic string) ([]string, error) {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	req, err := http.NewRequest("GET", addr+"/lookup?topic="+url.QueryEscape(topic), nil)
+	if err != nil {
+		return nil, errors.As(err, addr)
+	}
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, errors.As(err, addr)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.As(err, addr)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// the topic is not produced yet.
+		return []string{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("lookup failed").As(addr, resp.StatusCode, string(body))
+	}
+
+	r := &lookupResp{}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, errors.As(err, addr, string(body))
+	}
+	addrs := []string{}
+	for _, p := range append(r.Producers, r.Data.Producers...) {
+		addrs = append(addrs, net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort)))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,147 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testLookupd struct {
+	mu   sync.Mutex
+	resp map[string]string
+}
+
+func (l *testLookupd) set(topic, resp string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.resp[topic] = resp
+}
+
+func (l *testLookupd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	resp, ok := l.resp[r.URL.Query().Get("topic")]
+	if !ok {
+		http.Error(w, `{"message":"TOPIC_NOT_FOUND"}`, http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(resp))
+}
+
+func TestLookupd(t *testing.T) {
+	h := &testLookupd{resp: map[string]string{}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	h.set("testing_tube", `{"channels":["default"],"producers":[
+		{"broadcast_address":"10.0.0.2","tcp_port":4150,"http_port":4151},
+		{"broadcast_address":"10.0.0.1","tcp_port":4150,"http_port":4151}]}`)
+	// response of the old nsqlookupd
+	h.set("old_tube", `{"status_code":200,"status_txt":"OK","data":{"producers":[
+		{"broadcast_address":"10.0.0.3","tcp_port":4150}]}}`)
+
+	l := newLookupd()
+	l.addrs = []string{strings.TrimPrefix(srv.URL, "http://")}
+	l.interval = 0
+	nodes, err := l.Nodes("testing_tube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(nodes, ",") != "10.0.0.1:4150,10.0.0.2:4150" {
+		t.Fatal(nodes)
+	}
+	if nodes, err := l.Nodes("old_tube"); err != nil || strings.Join(nodes, ",") != "10.0.0.3:4150" {
+		t.Fatal(nodes, err)
+	}
+	if nodes, err := l.Nodes("unknown_tube"); err != nil || len(nodes) != 0 {
+		t.Fatal(nodes, err)
+	}
+
+	// a node is gone
+	h.set("testing_tube", `{"producers":[{"broadcast_address":"10.0.0.1","tcp_port":4150}]}`)
+	if nodes, err := l.Nodes("testing_tube"); err != nil || strings.Join(nodes, ",") != "10.0.0.1:4150" {
+		t.Fatal(nodes, err)
+	}
+
+	// keep the last nodes when the lookupd is down
+	srv.Close()
+	if nodes, err := l.Nodes("testing_tube"); err == nil || strings.Join(nodes, ",") != "10.0.0.1:4150" {
+		t.Fatal(nodes, err)
+	}
+}
+
+func TestConsumerNodes(t *testing.T) {
+	h := &testLookupd{resp: map[string]string{}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	h.set("testing_tube", `{"producers":[{"broadcast_address":"10.0.0.1","tcp_port":4150}]}`)
+
+	c := NewLookupdConsumer([]string{srv.URL}, "testing_tube", WithLookupdPollInterval(time.Hour)).(*consumer)
+	if nodes, err := c.nodes(); err != nil || strings.Join(nodes, ",") != "10.0.0.1:4150" {
+		t.Fatal(nodes, err)
+	}
+	// cached in the poll interval
+	h.set("testing_tube", `{"producers":[]}`)
+	if nodes, err := c.nodes(); err != nil || strings.Join(nodes, ",") != "10.0.0.1:4150" {
+		t.Fatal(nodes, err)
+	}
+
+	c = NewConsumer("127.0.0.1:4150", "testing_tube").(*consumer)
+	if nodes, err := c.nodes(); err != nil || strings.Join(nodes, ",") != "127.0.0.1:4150" {
+		t.Fatal(nodes, err)
+	}
+}
+
+// testLookupdProducers returns the response of lookupd with the nsqd nodes.
+func testLookupdProducers(t *testing.T, nodes ...*testNsqd) string {
+	producers := []string{}
+	for _, s := range nodes {
+		host, port, err := net.SplitHostPort(s.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		producers = append(producers, fmt.Sprintf(`{"broadcast_address":"%s","tcp_port":%s}`, host, port))
+	}
+	return `{"producers":[` + strings.Join(producers, ",") + `]}`
+}
+
+func TestConsumerLookupdNodes(t *testing.T) {
+	s1 := newTestNsqd(t)
+	defer s1.Close()
+	s2 := newTestNsqd(t)
+	defer s2.Close()
+
+	h := &testLookupd{resp: map[string]string{}}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	h.set("testing_tube", testLookupdProducers(t, s1, s2))
+
+	c := NewLookupdConsumer([]string{srv.URL}, "testing_tube", WithLookupdPollInterval(10*time.Millisecond))
+	defer c.Close()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		return nil
+	})
+	connected := func(s *testNsqd) func() bool {
+		return func() bool {
+			return len(s.clients) == 1
+		}
+	}
+	if !s1.Wait(3*time.Second, connected(s1)) || !s2.Wait(3*time.Second, connected(s2)) {
+		t.Fatal("not connected to both nodes")
+	}
+
+	// s2 is gone from lookupd
+	h.set("testing_tube", testLookupdProducers(t, s1))
+	if !s2.Wait(3*time.Second, func() bool { return len(s2.clients) == 0 }) {
+		t.Fatal("s2 not disconnected")
+	}
+	if !s1.Wait(time.Second, connected(s1)) {
+		t.Fatal("s1 disconnected")
+	}
+}
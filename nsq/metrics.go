@@ -0,0 +1,297 @@
+package nsq
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricType is the type of a metric family.
+type MetricType string
+
+const (
+	MetricCounter   MetricType = "counter"
+	MetricGauge     MetricType = "gauge"
+	MetricHistogram MetricType = "histogram"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the latency histograms.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// names of the built-in metrics
+const (
+	metricConsumerMessages    = "nsq_consumer_messages_total"
+	metricConsumerRequeues    = "nsq_consumer_requeues_total"
+	metricConsumerTimeouts    = "nsq_consumer_timeouts_total"
+	metricConsumerLateResults = "nsq_consumer_late_results_total"
+	metricConsumerPanics      = "nsq_consumer_panics_total"
+	metricConsumerDeadLetters = "nsq_consumer_dead_letters_total"
+	metricConsumerInFlight    = "nsq_consumer_in_flight"
+	metricConsumerHandle      = "nsq_consumer_handle_seconds"
+	metricProducerPuts        = "nsq_producer_puts_total"
+	metricProducerPut         = "nsq_producer_put_seconds"
+	metricProducerPoolWait    = "nsq_producer_pool_wait_seconds"
+	metricProducerFailovers   = "nsq_producer_failovers_total"
+	metricProducerNodeHealthy = "nsq_producer_node_healthy"
+	metricProducerSpooled     = "nsq_producer_spooled_total"
+	metricProducerSpoolBytes  = "nsq_producer_spool_bytes"
+)
+
+// Metrics is a registry of counters, gauges and histograms,
+// it's an http.Handler which renders the metrics in the Prometheus text format.
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	typ     MetricType
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels string
+	value  float64
+	// histogram
+	counts []uint64
+	count  uint64
+}
+
+// NewMetrics creates a registry with the built-in metrics described.
+func NewMetrics() *Metrics {
+	m := &Metrics{families: map[string]*metricFamily{}}
+	m.Describe(metricConsumerMessages, "Jobs handled by the consumer, by the action after handling.", MetricCounter)
+	m.Describe(metricConsumerRequeues, "Jobs requeued to nsqd.", MetricCounter)
+	m.Describe(metricConsumerTimeouts, "Jobs which exceed the handler timeout.", MetricCounter)
+	m.Describe(metricConsumerLateResults, "Results of the timed-out handlers which are ignored.", MetricCounter)
+	m.Describe(metricConsumerPanics, "Panics of the handlers.", MetricCounter)
+	m.Describe(metricConsumerDeadLetters, "Jobs published to the dead-letter topic.", MetricCounter)
+	m.Describe(metricConsumerInFlight, "Jobs being handled.", MetricGauge)
+	m.Describe(metricConsumerHandle, "Duration of the handlers in seconds.", MetricHistogram)
+	m.Describe(metricProducerPuts, "Puts of the producer, by the result.", MetricCounter)
+	m.Describe(metricProducerPut, "Duration of publishing to nsqd in seconds.", MetricHistogram)
+	m.Describe(metricProducerPoolWait, "Duration of waiting for a pool connection in seconds.", MetricHistogram)
+	m.Describe(metricProducerFailovers, "Puts failed over to the next nsqd node, by the node.", MetricCounter)
+	m.Describe(metricProducerNodeHealthy, "Health of the nsqd nodes of the producer, 1 is healthy.", MetricGauge)
+	m.Describe(metricProducerSpooled, "Messages appended to the spool.", MetricCounter)
+	m.Describe(metricProducerSpoolBytes, "Size of the spool in bytes.", MetricGauge)
+	return m
+}
+
+// DefaultMetrics is used by the consumers and producers which have no metrics set.
+var DefaultMetrics = NewMetrics()
+
+// WithMetrics sets the registry of the consumer metrics, default is DefaultMetrics, nil disables the metrics.
+func WithMetrics(m *Metrics) ConsumerOption {
+	return func(c *consumer) {
+		c.metrics = m
+	}
+}
+
+// WithProducerMetrics sets the registry of the producer metrics, default is DefaultMetrics, nil disables the metrics.
+func WithProducerMetrics(m *Metrics) ProducerOption {
+	return func(p *producer) {
+		p.metrics = m
+	}
+}
+
+// labels returns the metric labels of the consumer with the extra pairs.
+func (c *consumer) labels(extra ...string) []string {
+	return append([]string{"topic", c.tube, "channel", c.channel}, extra...)
+}
+
+// Describe sets the help text and the type of a metric family,
+// buckets are for the histogram, default is DefaultBuckets.
+func (m *Metrics) Describe(name, help string, typ MetricType, buckets ...float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.family(name, typ, buckets)
+	f.help = help
+}
+
+// Add adds v to the counter or the gauge,
+// labels are the pairs of name and value, like "topic", "test".
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.family(name, MetricCounter, nil).get(labels).value += v
+}
+
+// Set sets the gauge to v.
+func (m *Metrics) Set(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.family(name, MetricGauge, nil).get(labels).value = v
+}
+
+// Observe adds v to the histogram.
+func (m *Metrics) Observe(name string, v float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.family(name, MetricHistogram, nil)
+	s := f.get(labels)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(f.buckets))
+	}
+	for i, b := range f.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// since observes the seconds since start to the histogram.
+func (m *Metrics) since(name string, start time.Time, labels ...string) {
+	m.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+// family returns the metric family, it's created with the type if not exist, need lock.
+func (m *Metrics) family(name string, typ MetricType, buckets []float64) *metricFamily {
+	f, ok := m.families[name]
+	if !ok {
+		if len(buckets) == 0 {
+			buckets = DefaultBuckets
+		}
+		sorted := append([]float64{}, buckets...)
+		sort.Float64s(sorted)
+		f = &metricFamily{name: name, typ: typ, buckets: sorted, series: map[string]*metricSeries{}}
+		m.families[name] = f
+	}
+	return f
+}
+
+func (f *metricFamily) get(labels []string) *metricSeries {
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labels: key}
+		f.series[key] = s
+	}
+	return s
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the label pairs to `a="1",b="2"`.
+func formatLabels(labels []string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if len(labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	if len(labels) == 0 {
+		return "{" + extra + "}"
+	}
+	if len(extra) == 0 {
+		return "{" + labels + "}"
+	}
+	return "{" + labels + "," + extra + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name, f := range m.families {
+		if len(f.series) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, name := range names {
+		f := m.families[name]
+		if len(f.help) > 0 {
+			fmt.Fprintf(cw, "# HELP %s %s\n", name, strings.Replace(f.help, "\n", `\n`, -1))
+		}
+		fmt.Fprintf(cw, "# TYPE %s %s\n", name, f.typ)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.typ != MetricHistogram {
+				fmt.Fprintf(cw, "%s%s %s\n", name, joinLabels(key, ""), formatFloat(s.value))
+				continue
+			}
+			for i, b := range f.buckets {
+				var n uint64
+				if s.counts != nil {
+					n = s.counts[i]
+				}
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", name, joinLabels(key, `le="`+formatFloat(b)+`"`), n)
+			}
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", name, joinLabels(key, `le="+Inf"`), s.count)
+			fmt.Fprintf(cw, "%s_sum%s %s\n", name, joinLabels(key, ""), formatFloat(s.value))
+			fmt.Fprintf(cw, "%s_count%s %d\n", name, joinLabels(key, ""), s.count)
+		}
+	}
+	if err := cw.w.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,105 @@
+package nsq
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsText(t *testing.T) {
+	m := &Metrics{families: map[string]*metricFamily{}}
+	m.Describe("test_total", "Test counter.", MetricCounter)
+	m.Describe("test_seconds", "Test histogram.", MetricHistogram, 1, 0.5)
+	m.Add("test_total", 1, "topic", "a")
+	m.Add("test_total", 2, "topic", "a")
+	m.Add("test_total", 1, "topic", `b"\`)
+	m.Set("test_gauge", 3)
+	m.Observe("test_seconds", 0.2, "topic", "a")
+	m.Observe("test_seconds", 0.7, "topic", "a")
+	m.Observe("test_seconds", 2, "topic", "a")
+	m.Describe("test_unused", "Not rendered.", MetricCounter)
+
+	buf := &bytes.Buffer{}
+	n, err := m.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(n) != buf.Len() {
+		t.Fatal(n, buf.Len())
+	}
+	expect := `# TYPE test_gauge gauge
+test_gauge 3
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{topic="a",le="0.5"} 1
+test_seconds_bucket{topic="a",le="1"} 2
+test_seconds_bucket{topic="a",le="+Inf"} 3
+test_seconds_sum{topic="a"} 2.9
+test_seconds_count{topic="a"} 3
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{topic="a"} 3
+test_total{topic="b\"\\"} 1
+`
+	if buf.String() != expect {
+		t.Fatal(buf.String())
+	}
+
+	// nil registry disables the metrics.
+	var nilMetrics *Metrics
+	nilMetrics.Add("test_total", 1)
+	nilMetrics.Observe("test_seconds", 1)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := NewMetrics()
+	m.Add(metricProducerPuts, 1, "topic", "testing_tube", "result", "ok")
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatal(w.Header())
+	}
+	if !strings.Contains(w.Body.String(), `nsq_producer_puts_total{topic="testing_tube",result="ok"} 1`) {
+		t.Fatal(w.Body.String())
+	}
+}
+
+func TestConsumerMetrics(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	m := NewMetrics()
+	c := NewConsumer(s.Addr(), "testing_tube", WithMetrics(m), WithChannel("testing"))
+	defer c.Close()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		if string(job.Body) == "retry" {
+			return RetryAfter(time.Hour, nil)
+		}
+		return nil
+	})
+	s.Publish("testing_tube", []byte("testing"))
+	s.Publish("testing_tube", []byte("retry"))
+	if !s.Wait(time.Second, func() bool { return len(s.fin) == 1 && len(s.req) == 1 }) {
+		t.Fatal("not handled")
+	}
+
+	// the job is done after FIN or REQ is sent.
+	time.Sleep(100 * time.Millisecond)
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf)
+	for _, line := range []string{
+		`nsq_consumer_messages_total{topic="testing_tube",channel="testing",action="ack"} 1`,
+		`nsq_consumer_messages_total{topic="testing_tube",channel="testing",action="retry_after"} 1`,
+		`nsq_consumer_requeues_total{topic="testing_tube",channel="testing"} 1`,
+		`nsq_consumer_in_flight{topic="testing_tube",channel="testing"} 0`,
+		`nsq_consumer_handle_seconds_count{topic="testing_tube",channel="testing"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatal(line, buf.String())
+		}
+	}
+}
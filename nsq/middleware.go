@@ -0,0 +1,97 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gwaylib/errors"
+	"github.com/gwaylib/log/logger/proto"
+)
+
+// Middleware wraps a Handler with the common logic, HandleContext can be wrapped by HandleContext.Handler().
+type Middleware func(Handler) Handler
+
+// Chain makes the middlewares one, the first one is the outermost.
+func Chain(mws ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		return h
+	}
+}
+
+// WithMiddleware wraps every handler of Reserve with the middlewares, the first one is the outermost.
+// It can be set more than once, and the middlewares set before are outer.
+func WithMiddleware(mws ...Middleware) ConsumerOption {
+	return func(c *consumer) {
+		c.middlewares = append(c.middlewares, mws...)
+	}
+}
+
+// Logging logs the result and the duration of every job with the job id and the tried times.
+func Logging(l proto.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job, tried int) error {
+			start := time.Now()
+			err := next(ctx, job, tried)
+			o := outcomeOf(err)
+			line := fmt.Sprintf("job:%s tried:%d action:%s duration:%s", job.ID[:], tried, o.Action, time.Since(start))
+			if o.Err != nil {
+				l.Warn(line + " error:" + o.Err.Error())
+			} else {
+				l.Debug(line)
+			}
+			return err
+		}
+	}
+}
+
+// Recovery recovers the panic of handler and returns the outcome made by onPanic,
+// nil onPanic retries the job by the RetryPolicy of the consumer.
+func Recovery(onPanic func(job *Job, r interface{}) error) Middleware {
+	if onPanic == nil {
+		onPanic = func(job *Job, r interface{}) error {
+			return Retry(errors.New("panic").As(r))
+		}
+	}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job, tried int) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = onPanic(job, r)
+				}
+			}()
+			return next(ctx, job, tried)
+		}
+	}
+}
+
+// Duration reports the handling duration of every job to observe.
+func Duration(observe func(job *Job, d time.Duration, err error)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job, tried int) error {
+			start := time.Now()
+			err := next(ctx, job, tried)
+			observe(job, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Timeout sets the handler timeout of every attempt,
+// it can't be longer than the timeout of Reserve.
+func Timeout(timeout func(tried int) time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, job *Job, tried int) error {
+			d := timeout(tried)
+			if d <= 0 {
+				return next(ctx, job, tried)
+			}
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return next(ctx, job, tried)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package nsq
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	trace := []string{}
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, job *Job, tried int) error {
+				trace = append(trace, name)
+				return next(ctx, job, tried)
+			}
+		}
+	}
+	h := Chain(mw("a"), mw("b"), mw("c"))(func(ctx context.Context, job *Job, tried int) error {
+		trace = append(trace, "handle")
+		return nil
+	})
+	if err := h(context.TODO(), &Job{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(trace, ",") != "a,b,c,handle" {
+		t.Fatal(trace)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	panicHandle := func(ctx context.Context, job *Job, tried int) error {
+		panic("testing")
+	}
+	if o := outcomeOf(Recovery(nil)(panicHandle)(context.TODO(), &Job{}, 0)); o.Action != ActionRetry || o.Err == nil {
+		t.Fatal(o)
+	}
+	drop := Recovery(func(job *Job, r interface{}) error {
+		return Drop(errors.New(r.(string)))
+	})
+	if o := outcomeOf(drop(panicHandle)(context.TODO(), &Job{}, 0)); o.Action != ActionDrop || o.Err.Error() != "testing" {
+		t.Fatal(o)
+	}
+}
+
+func TestDurationAndTimeout(t *testing.T) {
+	var used time.Duration
+	h := Chain(
+		Duration(func(job *Job, d time.Duration, err error) {
+			used = d
+		}),
+		Timeout(func(tried int) time.Duration {
+			return time.Duration(tried+1) * 50 * time.Millisecond
+		}),
+	)(func(ctx context.Context, job *Job, tried int) error {
+		<-ctx.Done()
+		return Retry(ctx.Err())
+	})
+	if err := h(context.TODO(), &Job{}, 1); outcomeOf(err).Err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if used < 100*time.Millisecond || used > time.Second {
+		t.Fatal(used)
+	}
+}
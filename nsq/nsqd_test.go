@@ -0,0 +1,447 @@
+package nsq
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// testNsqd is a minimal nsqd speaking the tcp protocol v2 for testing.
+type testNsqd struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu      sync.Mutex
+	msgID   int
+	queue   map[string][]*nsq.Message
+	clients map[*testNsqdClient]bool
+	conns   int
+	fin     []nsq.MessageID
+	req     map[nsq.MessageID]time.Duration
+	touch   map[nsq.MessageID]int
+	pub     map[string][][]byte
+
+	// TLS of the connections, and the secret of AUTH.
+	tlsConfig  *tls.Config
+	authSecret string
+	// compressions enabled, and the one negotiated by every connection.
+	snappy, deflate bool
+	compressions    []string
+	// bodies of IDENTIFY
+	identify []map[string]interface{}
+	// max size of PUB, 0 is unlimited.
+	maxMsgSize int
+	// max size of MPUB, 0 is unlimited.
+	maxBodySize int
+	// delay the responses of PUB
+	pubDelay time.Duration
+	// count of MPUB
+	mpub int
+	// max delay of DPUB, 0 is unlimited.
+	maxReqTimeout time.Duration
+	// delays of DPUB
+	dpub []time.Duration
+	// requeue the messages after the delay of REQ, only the ones without delay are requeued by default.
+	deferReq bool
+	// listen address, default is a random port.
+	listen string
+}
+
+type testNsqdClient struct {
+	conn     net.Conn
+	w        io.Writer
+	wmu      sync.Mutex
+	topic    string
+	channel  string
+	rdy      int
+	closing  bool
+	inFlight map[nsq.MessageID]*nsq.Message
+	upgrade  bool
+	compress string
+	authed   bool
+}
+
+func newTestNsqd(t *testing.T, opts ...func(s *testNsqd)) *testNsqd {
+	s := &testNsqd{
+		t:       t,
+		listen:  "127.0.0.1:0",
+		queue:   map[string][]*nsq.Message{},
+		clients: map[*testNsqdClient]bool{},
+		req:     map[nsq.MessageID]time.Duration{},
+		touch:   map[nsq.MessageID]int{},
+		pub:     map[string][][]byte{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	ln, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ln = ln
+	go s.serve()
+	return s
+}
+
+func (s *testNsqd) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *testNsqd) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// Publish queues a message as a producer does.
+func (s *testNsqd) Publish(topic string, body []byte) nsq.MessageID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.publish(topic, body)
+}
+
+func (s *testNsqd) publish(topic string, body []byte) nsq.MessageID {
+	s.msgID++
+	id := nsq.MessageID{}
+	copy(id[:], fmt.Sprintf("%016x", s.msgID))
+	s.queue[topic] = append(s.queue[topic], nsq.NewMessage(id, body))
+	s.pub[topic] = append(s.pub[topic], body)
+	s.dispatch()
+	return id
+}
+
+// Wait waits for the cond becoming true under the lock of the server.
+func (s *testNsqd) Wait(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		ok := cond()
+		s.mu.Unlock()
+		if ok {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *testNsqd) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &testNsqdClient{conn: conn, w: conn, inFlight: map[nsq.MessageID]*nsq.Message{}}
+		s.mu.Lock()
+		s.conns++
+		s.clients[c] = true
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *testNsqd) handle(c *testNsqdClient) {
+	defer func() {
+		c.conn.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.clients, c)
+		// requeue the messages in flight as nsqd does.
+		for _, msg := range c.inFlight {
+			s.queue[c.topic] = append(s.queue[c.topic], msg)
+		}
+		s.dispatch()
+	}()
+
+	r := bufio.NewReader(c.conn)
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, nsq.MagicV2) {
+		return
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		params := bytes.Split(bytes.TrimSpace(line), []byte(" "))
+		var body []byte
+		switch string(params[0]) {
+		case "IDENTIFY", "AUTH", "PUB", "MPUB", "DPUB":
+			var size int32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			body = make([]byte, size)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+		}
+		if err := s.command(c, params, body); err != nil {
+			return
+		}
+		if c.upgrade {
+			// the client starts the handshake after the response of IDENTIFY.
+			c.upgrade = false
+			tc := tls.Server(c.conn, s.tlsConfig)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			s.mu.Lock()
+			c.wmu.Lock()
+			c.conn, c.w = tc, tc
+			c.wmu.Unlock()
+			s.mu.Unlock()
+			r = bufio.NewReader(tc)
+			if err := c.send(nsq.FrameTypeResponse, []byte("OK")); err != nil {
+				return
+			}
+		}
+		if len(c.compress) > 0 {
+			var cr io.Reader
+			var cw io.Writer
+			switch c.compress {
+			case "snappy":
+				cr, cw = snappy.NewReader(c.conn), snappy.NewWriter(c.conn)
+			case "deflate":
+				cr = flate.NewReader(c.conn)
+				cw, _ = flate.NewWriter(c.conn, flate.DefaultCompression)
+			}
+			c.compress = ""
+			s.mu.Lock()
+			c.wmu.Lock()
+			c.w = cw
+			c.wmu.Unlock()
+			s.mu.Unlock()
+			r = bufio.NewReader(cr)
+			if err := c.send(nsq.FrameTypeResponse, []byte("OK")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *testNsqd) command(c *testNsqdClient, params [][]byte, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch string(params[0]) {
+	case "IDENTIFY":
+		identify := struct {
+			TLSv1   bool `json:"tls_v1"`
+			Snappy  bool `json:"snappy"`
+			Deflate bool `json:"deflate"`
+		}{}
+		json.Unmarshal(body, &identify)
+		fields := map[string]interface{}{}
+		json.Unmarshal(body, &fields)
+		s.identify = append(s.identify, fields)
+		if identify.Snappy && identify.Deflate {
+			c.send(nsq.FrameTypeError, []byte("E_IDENTIFY_FAILED cannot enable both deflate and snappy compression"))
+			return io.EOF
+		}
+		c.upgrade = identify.TLSv1 && s.tlsConfig != nil
+		switch {
+		case identify.Snappy && s.snappy:
+			c.compress = "snappy"
+		case identify.Deflate && s.deflate:
+			c.compress = "deflate"
+		}
+		comp := c.compress
+		if len(comp) == 0 {
+			comp = "none"
+		}
+		s.compressions = append(s.compressions, comp)
+		resp, _ := json.Marshal(map[string]interface{}{
+			"max_rdy_count": 2500,
+			"tls_v1":        c.upgrade,
+			"snappy":        c.compress == "snappy",
+			"deflate":       c.compress == "deflate",
+			"auth_required": len(s.authSecret) > 0,
+		})
+		return c.send(nsq.FrameTypeResponse, resp)
+	case "AUTH":
+		if string(body) != s.authSecret {
+			c.send(nsq.FrameTypeError, []byte("E_AUTH_FAILED AUTH failed"))
+			return io.EOF
+		}
+		c.authed = true
+		return c.send(nsq.FrameTypeResponse, []byte(`{"identity":"testing","permission_count":1}`))
+	case "SUB", "PUB", "MPUB", "DPUB":
+		cmd := string(params[0])
+		if cmd != "SUB" && !isValidName(string(params[1])) {
+			c.send(nsq.FrameTypeError, []byte(fmt.Sprintf("E_BAD_TOPIC %s topic name %q is not valid", cmd, params[1])))
+			return io.EOF
+		}
+		if cmd != "SUB" && cmd != "MPUB" && s.maxMsgSize > 0 && len(body) > s.maxMsgSize {
+			c.send(nsq.FrameTypeError, []byte(fmt.Sprintf("E_BAD_MESSAGE %s message too big %d > %d", cmd, len(body), s.maxMsgSize)))
+			return io.EOF
+		}
+		if cmd == "MPUB" && s.maxBodySize > 0 && len(body) > s.maxBodySize {
+			c.send(nsq.FrameTypeError, []byte(fmt.Sprintf("E_BAD_BODY MPUB body too big %d > %d", len(body), s.maxBodySize)))
+			return io.EOF
+		}
+		if len(s.authSecret) > 0 && !c.authed {
+			c.send(nsq.FrameTypeError, []byte("E_AUTH_FIRST AUTH required before "+string(params[0])))
+			return io.EOF
+		}
+		return s.pubsub(c, params, body)
+	case "RDY":
+		c.rdy, _ = strconv.Atoi(string(params[1]))
+		s.dispatch()
+	case "FIN":
+		id := testMsgID(params[1])
+		delete(c.inFlight, id)
+		s.fin = append(s.fin, id)
+		s.dispatch()
+	case "REQ":
+		id := testMsgID(params[1])
+		ms, _ := strconv.Atoi(string(params[2]))
+		msg, ok := c.inFlight[id]
+		delete(c.inFlight, id)
+		s.req[id] = time.Duration(ms) * time.Millisecond
+		if ok && ms == 0 {
+			s.queue[c.topic] = append(s.queue[c.topic], msg)
+		} else if ok && s.deferReq {
+			topic := c.topic
+			time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.queue[topic] = append(s.queue[topic], msg)
+				s.dispatch()
+			})
+		}
+		s.dispatch()
+	case "TOUCH":
+		s.touch[testMsgID(params[1])]++
+	case "CLS":
+		c.closing = true
+		return c.send(nsq.FrameTypeResponse, []byte("CLOSE_WAIT"))
+	case "NOP":
+	default:
+		return c.send(nsq.FrameTypeError, []byte("E_INVALID invalid command "+string(params[0])))
+	}
+	return nil
+}
+
+// pubsub handles SUB, PUB, MPUB and DPUB, need lock.
+func (s *testNsqd) pubsub(c *testNsqdClient, params [][]byte, body []byte) error {
+	switch string(params[0]) {
+	case "SUB":
+		c.topic, c.channel = string(params[1]), string(params[2])
+	case "DPUB":
+		ms, _ := strconv.Atoi(string(params[2]))
+		delay := time.Duration(ms) * time.Millisecond
+		if ms < 0 || (s.maxReqTimeout > 0 && delay > s.maxReqTimeout) {
+			c.send(nsq.FrameTypeError, []byte(fmt.Sprintf("E_INVALID DPUB timeout %d out of range 0-%d", ms, s.maxReqTimeout/time.Millisecond)))
+			return io.EOF
+		}
+		s.dpub = append(s.dpub, delay)
+		topic := string(params[1])
+		time.AfterFunc(delay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.publish(topic, body)
+		})
+	case "MPUB":
+		msgs, err := readMPUB(body)
+		if err != nil {
+			c.send(nsq.FrameTypeError, []byte("E_BAD_BODY MPUB "+err.Error()))
+			return io.EOF
+		}
+		for _, msg := range msgs {
+			if s.maxMsgSize > 0 && len(msg) > s.maxMsgSize {
+				c.send(nsq.FrameTypeError, []byte(fmt.Sprintf("E_BAD_MESSAGE MPUB message too big %d > %d", len(msg), s.maxMsgSize)))
+				return io.EOF
+			}
+		}
+		s.mpub++
+		for _, msg := range msgs {
+			s.publish(string(params[1]), msg)
+		}
+	case "PUB":
+		s.publish(string(params[1]), body)
+		if s.pubDelay > 0 {
+			go func() {
+				time.Sleep(s.pubDelay)
+				c.send(nsq.FrameTypeResponse, []byte("OK"))
+			}()
+			return nil
+		}
+	}
+	return c.send(nsq.FrameTypeResponse, []byte("OK"))
+}
+
+// readMPUB reads the messages of the MPUB body: [count][size][data][size][data]...
+func readMPUB(body []byte) ([][]byte, error) {
+	if len(body) < 4 {
+		return nil, fmt.Errorf("invalid body size %d", len(body))
+	}
+	n := int(binary.BigEndian.Uint32(body))
+	body = body[4:]
+	msgs := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		if len(body) < 4 {
+			return nil, fmt.Errorf("invalid message %d", i)
+		}
+		size := int(binary.BigEndian.Uint32(body))
+		if len(body) < 4+size {
+			return nil, fmt.Errorf("invalid message %d", i)
+		}
+		msgs = append(msgs, body[4:4+size])
+		body = body[4+size:]
+	}
+	return msgs, nil
+}
+
+// dispatch sends the queued messages to the ready clients, need lock.
+func (s *testNsqd) dispatch() {
+	for c := range s.clients {
+		for !c.closing && len(c.inFlight) < c.rdy && len(s.queue[c.topic]) > 0 {
+			msg := s.queue[c.topic][0]
+			s.queue[c.topic] = s.queue[c.topic][1:]
+			msg.Attempts++
+			c.inFlight[msg.ID] = msg
+			buf := &bytes.Buffer{}
+			msg.WriteTo(buf)
+			c.send(nsq.FrameTypeMessage, buf.Bytes())
+		}
+	}
+}
+
+func (c *testNsqdClient) send(frameType int32, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(buf[:4], uint32(4+len(data)))
+	binary.BigEndian.PutUint32(buf[4:], uint32(frameType))
+	if _, err := c.w.Write(append(buf, data...)); err != nil {
+		return err
+	}
+	if f, ok := c.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func testMsgID(b []byte) nsq.MessageID {
+	id := nsq.MessageID{}
+	copy(id[:], b)
+	return id
+}
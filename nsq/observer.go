@@ -0,0 +1,142 @@
+package nsq
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gwaylib/log/logger/proto"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// EventType is the type of the connection event.
+type EventType int
+
+const (
+	// low-level TCP transport error, see Event.Err
+	EventIOError EventType = iota
+	// error frame from nsqd, see Event.Err
+	EventError
+	// a message is requeued with backoff
+	EventBackoff
+	// a message is requeued without backoff
+	EventContinue
+	// a message is finished, it's sent with every EventFinished and resumes the consumer in backoff
+	EventResume
+	// heartbeat from nsqd
+	EventHeartbeat
+	// the connection is closed after cleanup
+	EventClose
+	// FIN of a message is sent, see Event.MessageID
+	EventFinished
+	// REQ of a message is sent, see Event.MessageID
+	EventRequeued
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventIOError:
+		return "io_error"
+	case EventError:
+		return "error"
+	case EventBackoff:
+		return "backoff"
+	case EventContinue:
+		return "continue"
+	case EventResume:
+		return "resume"
+	case EventHeartbeat:
+		return "heartbeat"
+	case EventClose:
+		return "close"
+	case EventFinished:
+		return "finished"
+	case EventRequeued:
+		return "requeued"
+	}
+	return fmt.Sprintf("event(%d)", int(t))
+}
+
+// Event is a connection event of nsqd.
+type Event struct {
+	Type EventType
+	// name of the delegate, "consumer" or "producer".
+	Name string
+	// address of the nsqd
+	Addr      string
+	Err       error
+	MessageID nsq.MessageID
+}
+
+// Observer receives the connection events,
+// it's called in the goroutines of the connection, so it should not block.
+type Observer interface {
+	OnEvent(e *Event)
+}
+
+// ObserverFunc adapts a function to Observer.
+type ObserverFunc func(e *Event)
+
+func (f ObserverFunc) OnEvent(e *Event) {
+	f(e)
+}
+
+// WithObserver sets the observer of the connection events.
+func WithObserver(o Observer) ConsumerOption {
+	return func(c *consumer) {
+		c.observer = o
+	}
+}
+
+// WithLogger sets the logger of the consumer.
+func WithLogger(l proto.Logger) ConsumerOption {
+	return func(c *consumer) {
+		c.log = l
+	}
+}
+
+// WithLogLevel sets the log level of the nsqd connections, default is nsq.LogLevelInfo.
+func WithLogLevel(lvl nsq.LogLevel) ConsumerOption {
+	return func(c *consumer) {
+		c.logLevel = lvl
+	}
+}
+
+// WithProducerObserver sets the observer of the producer connection events.
+func WithProducerObserver(o Observer) ProducerOption {
+	return func(p *producer) {
+		p.observer = o
+	}
+}
+
+// WithProducerLogger sets the logger of the producer.
+func WithProducerLogger(l proto.Logger) ProducerOption {
+	return func(p *producer) {
+		p.log = l
+	}
+}
+
+// WithProducerLogLevel sets the log level of the producer connections, default is nsq.LogLevelInfo.
+func WithProducerLogLevel(lvl nsq.LogLevel) ProducerOption {
+	return func(p *producer) {
+		p.logLevel = lvl
+	}
+}
+
+// nsqLogger adapts proto.Logger to the logger of go-nsq.
+type nsqLogger struct {
+	log proto.Logger
+}
+
+func (l *nsqLogger) Output(calldepth int, s string) error {
+	switch {
+	case strings.HasPrefix(s, nsq.LogLevelDebug.String()):
+		l.log.Debug(s)
+	case strings.HasPrefix(s, nsq.LogLevelInfo.String()):
+		l.log.Info(s)
+	case strings.HasPrefix(s, nsq.LogLevelWarning.String()):
+		l.log.Warn(s)
+	default:
+		l.log.Error(s)
+	}
+	return nil
+}
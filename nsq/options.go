@@ -0,0 +1,85 @@
+package nsq
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// WithConfig sets the base config of the nsqd connections, default is nsq.NewConfig().
+// The config is copied for every connection, and the values set by the other options override it.
+// RDY and backoff are managed by the consumer, see WithMaxInFlight and WithBackoff.
+func WithConfig(config *nsq.Config) ConsumerOption {
+	return func(c *consumer) {
+		c.config = config
+	}
+}
+
+// WithLocalAddr sets the local address to connect nsqd, default is chosen by the system.
+func WithLocalAddr(addr net.Addr) ConsumerOption {
+	return func(c *consumer) {
+		c.localAddr = addr
+	}
+}
+
+// WithHeartbeat sets the heartbeat interval of the nsqd connections, default is 30 seconds.
+func WithHeartbeat(interval time.Duration) ConsumerOption {
+	return func(c *consumer) {
+		c.heartbeat = interval
+	}
+}
+
+// WithProducerConfig sets the base config of the producer connections, see WithConfig.
+func WithProducerConfig(config *nsq.Config) ProducerOption {
+	return func(p *producer) {
+		p.config = config
+	}
+}
+
+// WithProducerLocalAddr sets the local address of the producer connections.
+func WithProducerLocalAddr(addr net.Addr) ProducerOption {
+	return func(p *producer) {
+		p.localAddr = addr
+	}
+}
+
+// WithProducerHeartbeat sets the heartbeat interval of the producer connections.
+func WithProducerHeartbeat(interval time.Duration) ProducerOption {
+	return func(p *producer) {
+		p.heartbeat = interval
+	}
+}
+
+// connOptions is the connection settings shared by the consumer and the producer.
+type connOptions struct {
+	config       *nsq.Config
+	localAddr    net.Addr
+	heartbeat    time.Duration
+	tlsConfig    *tls.Config
+	authSecret   string
+	compressions []Compression
+}
+
+// newConfig copies the base config and sets the options to it.
+func (o *connOptions) newConfig() *nsq.Config {
+	config := nsq.NewConfig()
+	if o.config != nil {
+		*config = *o.config
+	}
+	if o.localAddr != nil {
+		config.LocalAddr = o.localAddr
+	}
+	if o.heartbeat != 0 {
+		config.HeartbeatInterval = o.heartbeat
+	}
+	if o.tlsConfig != nil {
+		config.TlsV1 = true
+		config.TlsConfig = o.tlsConfig
+	}
+	if len(o.authSecret) > 0 {
+		config.AuthSecret = o.authSecret
+	}
+	return config
+}
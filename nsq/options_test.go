@@ -0,0 +1,69 @@
+package nsq
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+func TestNewConfig(t *testing.T) {
+	// the defaults of go-nsq for production.
+	c := NewConsumer(addr, topicName).(*consumer)
+	config := c.newConfig()
+	if config.LocalAddr != nil || config.DefaultRequeueDelay != 90*time.Second || config.MaxBackoffDuration != 2*time.Minute {
+		t.Fatal(config.LocalAddr, config.DefaultRequeueDelay, config.MaxBackoffDuration)
+	}
+
+	base := nsq.NewConfig()
+	base.MsgTimeout = 30 * time.Second
+	base.HeartbeatInterval = 10 * time.Second
+	base.AuthSecret = "base"
+	local := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+	c = NewConsumer(addr, topicName, WithConfig(base), WithLocalAddr(local), WithHeartbeat(5*time.Second)).(*consumer)
+	config = c.newConfig()
+	if config == base || config.LocalAddr != local || config.HeartbeatInterval != 5*time.Second || config.AuthSecret != "base" {
+		t.Fatal(config)
+	}
+	if base.LocalAddr != nil || base.HeartbeatInterval != 10*time.Second {
+		t.Fatal("base config changed")
+	}
+	// the jobs are touched by the timeout of the base config.
+	if c.touchInterval() != 15*time.Second {
+		t.Fatal(c.touchInterval())
+	}
+
+	p := NewProducer(1, addr, topicName, WithProducerConfig(base), WithProducerAuthSecret("secret")).(*producer)
+	if config := p.newConfig(); config.AuthSecret != "secret" || config.HeartbeatInterval != 10*time.Second {
+		t.Fatal(config)
+	}
+}
+
+func TestConnConfig(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube", WithProducerHeartbeat(5*time.Second))
+	defer p.Close()
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	c := NewConsumer(s.Addr(), "testing_tube", WithHeartbeat(3*time.Second), WithMsgTimeout(20*time.Second))
+	defer c.Close()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		return nil
+	})
+	if !s.Wait(5*time.Second, func() bool { return len(s.fin) == 1 }) {
+		t.Fatal("not finished")
+	}
+	if !s.Wait(0, func() bool {
+		return len(s.identify) == 2 &&
+			s.identify[0]["heartbeat_interval"] == float64(5000) &&
+			s.identify[1]["heartbeat_interval"] == float64(3000) &&
+			s.identify[1]["msg_timeout"] == float64(20000)
+	}) {
+		t.Fatal(s.identify)
+	}
+}
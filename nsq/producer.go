@@ -2,11 +2,15 @@ package nsq
 
 import (
 	"io"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gwaylib/errors"
-	"github.com/gwaylib/log"
+	"github.com/gwaylib/log/logger"
+	"github.com/gwaylib/log/logger/adapter/stdio"
+	"github.com/gwaylib/log/logger/proto"
 	nsq "github.com/nsqio/go-nsq"
 )
 
@@ -14,47 +18,221 @@ import (
 type Producer interface {
 	io.Closer
 	Put(data []byte) error
+
+	// PutMany publishes the messages by MPUB, they're split by the max body size of nsqd,
+	// every part is atomic, and the parts before the failed one are published.
+	PutMany(data [][]byte) error
+
+	// PutDelay publishes the message which is delivered after the delay.
+	PutDelay(data []byte, delay time.Duration) error
+
+	// PutTopic, PutManyTopic and PutDelayTopic publish to the topic instead of the one of NewProducer,
+	// the connections are shared by all the topics.
+	PutTopic(topic string, data []byte) error
+	PutManyTopic(topic string, data [][]byte) error
+	PutDelayTopic(topic string, data []byte, delay time.Duration) error
+
+	// PutHeaders publishes the data in the envelope with the headers, see Envelope.
+	PutHeaders(topic string, data []byte, headers map[string]string) error
+}
+
+// ProducerOption sets an optional value of the Producer.
+type ProducerOption func(*producer)
+
+// WithFireAndForget makes Put return after the PUB is written without waiting for the response of nsqd,
+// the errors of nsqd are logged only.
+func WithFireAndForget() ProducerOption {
+	return func(p *producer) {
+		p.fireAndForget = true
+	}
+}
+
+// WithMaxBodySize sets the max body size of MPUB which is the max-body-size of nsqd, default is 5MB.
+func WithMaxBodySize(size int) ProducerOption {
+	return func(p *producer) {
+		if size > 0 {
+			p.maxBodySize = size
+		}
+	}
+}
+
+// WithPutTimeout sets the timeout to wait for the response of nsqd, default is 10 seconds.
+func WithPutTimeout(timeout time.Duration) ProducerOption {
+	return func(p *producer) {
+		if timeout > 0 {
+			p.putTimeout = timeout
+		}
+	}
 }
 
 type producer struct {
-	addr        string
+	connOptions
+	log      proto.Logger
+	logLevel nsq.LogLevel
+	observer Observer
+
+	// wait for the response of nsqd or not
+	fireAndForget bool
+	putTimeout    time.Duration
+	maxBodySize   int
+	maxReqTimeout time.Duration
+	batch         *batcher
+	// wrap the messages in the envelope
+	envelope bool
+	source   string
+
+	// nsqd nodes and the selection of them
+	addrs         []string
+	nodes         []*node
+	strategy      Strategy
+	next          uint32
+	maxFails      int
+	probeInterval time.Duration
+	probeWg       sync.WaitGroup
+
+	// puts which are failed by the nodes
+	spool    *spool
+	replayWg sync.WaitGroup
+
 	tube        string
 	borrowEvent chan bool
 	poolSync    sync.Mutex
-	curPoolSize int
 	maxPoolSize int
 	isClosed    bool
-	pool        sync.Pool
+	metrics     *Metrics
+
+	// signal command.
+	sig_exit chan bool
 }
 
 // 通过一个连接池发送数据给beanstalkd，若需要顺序发送，请将池设定为1
 func (p *producer) Put(data []byte) error {
+	return p.PutTopic(p.tube, data)
+}
+
+func (p *producer) PutTopic(topic string, data []byte) error {
+	if p.envelope {
+		wrapped, err := p.wrap(data, nil)
+		if err != nil {
+			return err
+		}
+		data = wrapped
+	}
+	return p.putTopic(topic, data)
+}
+
+func (p *producer) putTopic(topic string, data []byte) error {
 	p.poolSync.Lock()
 	if p.isClosed {
+		p.poolSync.Unlock()
 		return errors.New("producer has closed")
 	}
 	p.poolSync.Unlock()
 
+	if p.batch != nil {
+		return p.batch.put(topic, data)
+	}
+	return p.send(&spoolRecord{topic: topic, data: [][]byte{data}})
+}
+
+func (p *producer) PutMany(data [][]byte) error {
+	return p.PutManyTopic(p.tube, data)
+}
+
+func (p *producer) PutManyTopic(topic string, data [][]byte) error {
+	p.poolSync.Lock()
+	if p.isClosed {
+		p.poolSync.Unlock()
+		return errors.New("producer has closed")
+	}
+	p.poolSync.Unlock()
+
+	if p.envelope {
+		wrapped := make([][]byte, len(data))
+		for i, d := range data {
+			w, err := p.wrap(d, nil)
+			if err != nil {
+				return err
+			}
+			wrapped[i] = w
+		}
+		data = wrapped
+	}
+	parts, err := splitBody(data, p.maxBodySize)
+	if err != nil {
+		return errors.As(err, topic)
+	}
+	for _, part := range parts {
+		if err := p.send(&spoolRecord{topic: topic, data: part}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putMany publishes the messages in one MPUB.
+func (p *producer) putMany(topic string, data [][]byte) error {
+	if len(data) == 1 {
+		// PUB is cheaper for one message.
+		return p.do(topic, 1, func(c *conn) error {
+			return c.put(topic, data[0])
+		})
+	}
+	return p.do(topic, len(data), func(c *conn) error {
+		return c.putMany(topic, data)
+	})
+}
+
+// do borrows a connection of the pool to publish n messages to the topic.
+func (p *producer) do(topic string, n int, fn func(c *conn) error) error {
 	// 借调事件, 若超过池的大小，需要等待池的归还后才能继续
+	start := time.Now()
 	p.borrowEvent <- true
 	defer func() {
 		<-p.borrowEvent
 	}()
+	p.metrics.since(metricProducerPoolWait, start, "topic", topic)
 
-	conn := p.pool.Get().(*conn)
-	defer p.pool.Put(conn)
-
-	if err := conn.put(data); err != nil {
-		return errors.As(err)
+	// fail over to the next node when the connection is failed,
+	// the error of the last node is returned if all of them failed.
+	var err error
+	for i, nd := range p.selectNodes() {
+		if i > 0 {
+			p.metrics.Add(metricProducerFailovers, 1, "addr", nd.addr)
+		}
+		start = time.Now()
+		err = nd.do(fn)
+		latency := time.Since(start)
+		p.metrics.since(metricProducerPut, start, "topic", topic)
+		if err == nil {
+			p.nodeSucceed(nd, latency)
+			p.metrics.Add(metricProducerPuts, float64(n), "topic", topic, "result", "ok")
+			return nil
+		}
+		if !isNodeErr(err) {
+			break
+		}
+		p.nodeFailed(nd, err)
 	}
-	return nil
+	p.metrics.Add(metricProducerPuts, float64(n), "topic", topic, "result", "error")
+	return errors.As(err)
 }
 
 func (p *producer) Close() error {
 	p.poolSync.Lock()
+	if p.isClosed {
+		p.poolSync.Unlock()
+		return nil
+	}
 	p.isClosed = true
 	p.poolSync.Unlock()
 
+	if p.batch != nil {
+		// publish the messages in batch at first.
+		p.batch.close()
+	}
+	close(p.sig_exit)
+	p.replayWg.Wait()
 	for i := p.maxPoolSize; i > 0; i-- {
 		p.borrowEvent <- true
 	}
@@ -63,35 +241,124 @@ func (p *producer) Close() error {
 		<-p.borrowEvent
 	}
 
-	for i := p.curPoolSize; i > 0; i-- {
-		conn := p.pool.Get().(*conn)
-		conn.disconn()
+	p.probeWg.Wait()
+	for _, nd := range p.nodes {
+		nd.close()
+	}
+	if p.spool != nil {
+		return p.spool.close()
 	}
 	return nil
 }
 
-// NewProducer create Producer object.
-func NewProducer(size int, addr, tube string) Producer {
+// NewProducer create Producer object, tube is the topic of Put, PutMany and PutDelay, the options are optional,
+// and the connections use the defaults of go-nsq, see WithProducerConfig.
+// The connections are pooled by every nsqd node, size is the max puts at the same time.
+func NewProducer(size int, addr, tube string, opts ...ProducerOption) Producer {
+	p := newProducer(size, addr, tube, opts...)
+	p.start()
+	return p
+}
+
+func newProducer(size int, addr, tube string, opts ...ProducerOption) *producer {
 	if size < 1 {
 		panic("need size > 0")
 	}
 	p := &producer{
-		addr:        addr,
-		tube:        tube,
-		borrowEvent: make(chan bool, size),
+		log:           logger.New(tube, stdio.New(os.Stderr)),
+		logLevel:      nsq.LogLevelInfo,
+		tube:          tube,
+		borrowEvent:   make(chan bool, size),
+		maxPoolSize:   size,
+		putTimeout:    defaultPutTimeout,
+		maxBodySize:   defaultMaxBodySize,
+		maxReqTimeout: defaultMaxReqTimeout,
+		metrics:       DefaultMetrics,
+		maxFails:      defaultMaxFails,
+		probeInterval: defaultProbeInterval,
+		sig_exit:      make(chan bool),
 	}
-	p.pool.New = func() interface{} {
-		p.poolSync.Lock()
-		defer p.poolSync.Unlock()
-		p.curPoolSize += 1
-		return newConn(addr, tube)
+	if len(addr) > 0 {
+		p.addrs = []string{addr}
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if len(p.addrs) == 0 {
+		panic("need nsqd addr")
+	}
+	for _, addr := range p.addrs {
+		p.nodes = append(p.nodes, newNode(p, addr))
+		p.metrics.Set(metricProducerNodeHealthy, 1, "addr", addr)
 	}
 	return p
 }
 
+// start starts the background goroutines of the producer.
+func (p *producer) start() {
+	if p.spool != nil {
+		p.metrics.Set(metricProducerSpoolBytes, float64(p.spool.bytes()))
+		p.replayWg.Add(1)
+		go p.replay()
+	}
+	if p.batch != nil {
+		p.batch.start(p)
+	}
+}
+
 // ErrClosed closed by Close
 var ErrClosed = errors.New("msq: closed")
 
+const (
+	defaultPutTimeout = 10 * time.Second
+	// the max-body-size of nsqd
+	defaultMaxBodySize = 5 * 1024 * 1024
+)
+
+// errors of Put, they're checked by Equal.
+var (
+	// the topic name is invalid
+	ErrBadTopic = errors.New("E_BAD_TOPIC")
+	// the message is empty or invalid
+	ErrBadMessage = errors.New("E_BAD_MESSAGE")
+	// the message is bigger than the max-msg-size of nsqd
+	ErrMessageTooBig = errors.New("message too big")
+	// failed to connect nsqd
+	ErrConnect = errors.New("connect nsqd failed")
+	// nsqd failed to put the message
+	ErrPutFailed = errors.New("E_PUB_FAILED")
+	// the connection is closed before the response
+	ErrConnClosed = errors.New("nsqd connection closed")
+	// no response in the put timeout
+	ErrPutTimeout = errors.New("put timeout")
+)
+
+// putError makes the error frame of nsqd to the errors of Put,
+// the frame is like "E_BAD_TOPIC PUB topic name "a b" is not valid".
+func putError(data []byte, addr string) error {
+	frame := string(data)
+	code := frame
+	if i := strings.Index(frame, " "); i > 0 {
+		code = frame[:i]
+	}
+	switch code {
+	case "E_BAD_TOPIC":
+		return ErrBadTopic.As(addr, frame)
+	case "E_BAD_MESSAGE", "E_BAD_BODY":
+		if strings.Contains(frame, "too big") {
+			return ErrMessageTooBig.As(addr, frame)
+		}
+		return ErrBadMessage.As(addr, frame)
+	case "E_PUB_FAILED", "E_MPUB_FAILED", "E_DPUB_FAILED":
+		return ErrPutFailed.As(addr, frame)
+	case "E_INVALID":
+		if strings.HasPrefix(frame, "E_INVALID DPUB") {
+			return ErrInvalidDelay.As(addr, frame)
+		}
+	}
+	return errors.New(code).As(addr, frame)
+}
+
 func isBrokenPipeErr(err error) bool {
 	if err != nil && strings.Contains(err.Error(), "broken pipe") {
 		return true
@@ -99,18 +366,20 @@ func isBrokenPipeErr(err error) bool {
 	return false
 }
 
-// conn implements Producer and Workder and io.Closer
+// conn is a connection of the producer pool, it publishes to any topic of the nsqd.
 type conn struct {
-	addr, tube string
-	mu         sync.Mutex
-	conn       *nsq.Conn
-	closed     bool
+	addr     string
+	producer *producer
+	mu       sync.Mutex
+	conn     *nsq.Conn
+	delegate *Delegate
+	closed   bool
 }
 
-func newConn(addr, tube string) *conn {
+func newConn(p *producer, addr string) *conn {
 	return &conn{
-		addr: addr,
-		tube: tube,
+		addr:     addr,
+		producer: p,
 	}
 }
 
@@ -119,25 +388,39 @@ func (p *conn) connect() error {
 		return nil
 	}
 
-	c := nsq.NewConn(p.addr, nsq.NewConfig(), NewDelegate("producer"))
-	_, err := c.Connect()
+	delegate := NewDelegate("producer")
+	delegate.log = p.producer.log
+	delegate.observer = p.producer.observer
+	c, _, err := p.producer.dial(p.addr, p.producer.newConfig(), delegate, func(conn *nsq.Conn) {
+		conn.SetLogger(&nsqLogger{p.producer.log}, p.producer.logLevel, "")
+	})
 	if err != nil {
-		return err
+		if isSecurityErr(err) {
+			return err
+		}
+		return ErrConnect.As(err)
 	}
 	p.conn = c
+	p.delegate = delegate
 	return nil
 }
 
-func (p *conn) disconn() error {
+// reset closes the connection, it's connected again by the next put.
+func (p *conn) reset() {
 	if p.conn != nil {
 		if err := p.conn.Flush(); err != nil {
-			log.Warn(errors.As(err))
+			p.producer.log.Warn(errors.As(err))
 		}
 		if err := p.conn.Close(); err != nil {
-			log.Warn(errors.As(err))
+			p.producer.log.Warn(errors.As(err))
 		}
 		p.conn = nil
+		p.delegate = nil
 	}
+}
+
+func (p *conn) disconn() error {
+	p.reset()
 	p.closed = true
 	return nil
 }
@@ -146,19 +429,91 @@ func (p *conn) isClosed() bool {
 	return p.closed
 }
 
-func (p *conn) put(data []byte) error {
+func (p *conn) put(topic string, data []byte) error {
+	if p.isClosed() {
+		return ErrClosed
+	}
+
+	if err := p.connect(); err != nil {
+		p.reset()
+		return errors.As(err)
+	}
+
+	return p.publish(nsq.Publish(topic, data))
+}
+
+func (p *conn) putMany(topic string, data [][]byte) error {
 	if p.isClosed() {
 		return ErrClosed
 	}
 
 	if err := p.connect(); err != nil {
-		p.disconn()
+		p.reset()
 		return errors.As(err)
 	}
 
-	if err := p.conn.WriteCommand(nsq.Publish(p.tube, data)); err != nil {
-		p.disconn()
+	cmd, err := nsq.MultiPublish(topic, data)
+	if err != nil {
 		return errors.As(err)
 	}
+	return p.publish(cmd)
+}
+
+// publish writes the command of PUB, MPUB or DPUB, and waits for the response.
+func (p *conn) publish(cmd *nsq.Command) error {
+	if err := p.conn.WriteCommand(cmd); err != nil {
+		p.reset()
+		return ErrConnClosed.As(err, p.addr)
+	}
+	if p.producer.fireAndForget {
+		return nil
+	}
+	if err := p.await(); err != nil {
+		// the responses after are not matched, connect again.
+		p.reset()
+		return err
+	}
 	return nil
 }
+
+// await waits for the response of the command written,
+// the commands of a connection are responded in order, and a connection is used by one put at the same time.
+func (p *conn) await() error {
+	timer := time.NewTimer(p.producer.putTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.delegate.resp:
+			return nil
+		case data := <-p.delegate.err:
+			return putError(data, p.addr)
+		case e := <-p.delegate.ioErr:
+			if e.conn != p.conn {
+				// the late event of an earlier connection, e.g. the one rejected by the compression.
+				continue
+			}
+			return p.closedError(e.err)
+		case conn := <-p.delegate.close:
+			if conn != p.conn {
+				continue
+			}
+			return p.closedError(nil)
+		case <-timer.C:
+			return ErrPutTimeout.As(p.addr)
+		}
+	}
+}
+
+// closedError returns the error frame received before closing if there is,
+// nsqd closes the connection after the fatal error.
+func (p *conn) closedError(cause error) error {
+	select {
+	case data := <-p.delegate.err:
+		return putError(data, p.addr)
+	default:
+	}
+	if cause != nil {
+		return ErrConnClosed.As(cause, p.addr)
+	}
+	return ErrConnClosed.As(p.addr)
+}
@@ -0,0 +1,227 @@
+package nsq
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProducerConfirm(t *testing.T) {
+	s := newTestNsqd(t, func(s *testNsqd) {
+		s.maxMsgSize = 10
+	})
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube")
+	defer p.Close()
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put([]byte(strings.Repeat("a", 11))); !ErrMessageTooBig.Equal(err) {
+		t.Fatal(err)
+	}
+	// connect again after the error.
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Wait(0, func() bool { return len(s.pub["testing_tube"]) == 2 }) {
+		t.Fatal(len(s.pub["testing_tube"]))
+	}
+
+	bad := NewProducer(1, s.Addr(), "a!b")
+	defer bad.Close()
+	if err := bad.Put([]byte("testing")); !ErrBadTopic.Equal(err) {
+		t.Fatal(err)
+	}
+
+	// use the connection directly, the pool may drop it.
+	c := newConn(p.(*producer), s.Addr())
+	if err := c.put("testing_tube", []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	time.Sleep(100 * time.Millisecond)
+	if err := c.put("testing_tube", []byte("testing")); !ErrConnClosed.Equal(err) {
+		t.Fatal(err)
+	}
+	c.disconn()
+}
+
+func TestProducerPutTimeout(t *testing.T) {
+	s := newTestNsqd(t, func(s *testNsqd) {
+		s.pubDelay = 300 * time.Millisecond
+	})
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube", WithPutTimeout(100*time.Millisecond))
+	defer p.Close()
+	if err := p.Put([]byte("testing")); !ErrPutTimeout.Equal(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestProducerFireAndForget(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "a!b", WithFireAndForget())
+	defer p.Close()
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProducerPutMany(t *testing.T) {
+	s := newTestNsqd(t, func(s *testNsqd) {
+		s.maxBodySize = 4 + 3*(4+7)
+	})
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube", WithMaxBodySize(4+3*(4+7)))
+	defer p.Close()
+	data := [][]byte{}
+	for i := 0; i < 7; i++ {
+		data = append(data, []byte("testing"))
+	}
+	if err := p.PutMany(data); err != nil {
+		t.Fatal(err)
+	}
+	// 3 + 3 by MPUB, and the last one by PUB.
+	if !s.Wait(time.Second, func() bool { return len(s.pub["testing_tube"]) == 7 && s.mpub == 2 }) {
+		t.Fatal(len(s.pub["testing_tube"]), s.mpub)
+	}
+	if err := p.PutMany([][]byte{[]byte(strings.Repeat("a", 4*(4+7)))}); !ErrMessageTooBig.Equal(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestProducerBatch(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	p := NewProducer(2, s.Addr(), "testing_tube", WithBatch(10, 0, 50*time.Millisecond))
+	var wg sync.WaitGroup
+	errs := make(chan error, 25)
+	for i := 0; i < 25; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- p.Put([]byte("testing"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.Wait(0, func() bool { return len(s.pub["testing_tube"]) == 25 && s.mpub >= 2 }) {
+		t.Fatal(len(s.pub["testing_tube"]), s.mpub)
+	}
+
+	// every caller gets the result of its batch.
+	bad := NewProducer(1, s.Addr(), "a!b", WithBatch(2, 0, time.Second))
+	defer bad.Close()
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := bad.Put([]byte("testing")); !ErrBadTopic.Equal(err) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the messages accumulated are published by Close.
+	go p.Put([]byte("closing"))
+	time.Sleep(10 * time.Millisecond)
+	p.Close()
+	if !s.Wait(0, func() bool { return len(s.pub["testing_tube"]) == 26 }) {
+		t.Fatal(len(s.pub["testing_tube"]))
+	}
+	if err := p.Put([]byte("testing")); err == nil {
+		t.Fatal("expect closed")
+	}
+}
+
+func TestProducerBatchTooBig(t *testing.T) {
+	s := newTestNsqd(t, func(s *testNsqd) {
+		s.maxMsgSize = 10
+	})
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube", WithBatch(2, 64, time.Second))
+	defer p.Close()
+	// the message is bigger than the batch bytes.
+	if err := p.Put(make([]byte, 64)); !ErrMessageTooBig.Equal(err) {
+		t.Fatal(err)
+	}
+
+	// only the caller of the message bigger than max-msg-size fails.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, data := range [][]byte{[]byte("ok"), make([]byte, 20)} {
+		wg.Add(1)
+		go func(i int, data []byte) {
+			defer wg.Done()
+			errs[i] = p.Put(data)
+		}(i, data)
+	}
+	wg.Wait()
+	if errs[0] != nil || !ErrMessageTooBig.Equal(errs[1]) {
+		t.Fatal(errs)
+	}
+	if !s.Wait(time.Second, func() bool { return len(s.pub["testing_tube"]) == 1 }) {
+		t.Fatal(len(s.pub["testing_tube"]))
+	}
+}
+
+func TestProducerPutTopic(t *testing.T) {
+	s := newTestNsqd(t)
+	defer s.Close()
+
+	p := NewProducer(1, s.Addr(), "testing_tube")
+	defer p.Close()
+	if err := p.PutTopic("testing_a", []byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PutManyTopic("testing_b", [][]byte{[]byte("testing"), []byte("testing")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PutDelayTopic("testing_c", []byte("testing"), 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PutTopic("a!b", []byte("testing")); !ErrBadTopic.Equal(err) {
+		t.Fatal(err)
+	}
+	if !s.Wait(time.Second, func() bool {
+		return len(s.pub["testing_a"]) == 1 && len(s.pub["testing_b"]) == 2 &&
+			len(s.pub["testing_c"]) == 1 && len(s.pub["testing_tube"]) == 1
+	}) {
+		t.Fatal(s.pub)
+	}
+
+	// batches are accumulated by topic.
+	b := NewProducer(1, s.Addr(), "testing_tube", WithBatch(2, 0, time.Minute))
+	var wg sync.WaitGroup
+	for _, topic := range []string{"testing_d", "testing_e", "testing_d", "testing_e"} {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			if err := b.PutTopic(topic, []byte(topic)); err != nil {
+				t.Error(err)
+			}
+		}(topic)
+	}
+	wg.Wait()
+	b.Close()
+	if !s.Wait(0, func() bool { return len(s.pub["testing_d"]) == 2 && len(s.pub["testing_e"]) == 2 && s.mpub == 3 }) {
+		t.Fatal(s.pub, s.mpub)
+	}
+}
@@ -0,0 +1,87 @@
+package nsq
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides when a failed job is delivered again.
+type RetryPolicy interface {
+	// Next returns the delay before the next delivery.
+	// tried is the number of failed deliveries including the current one,
+	// return false to give up the job.
+	Next(tried int) (time.Duration, bool)
+}
+
+// RetryPolicyFunc adapts a function to RetryPolicy.
+type RetryPolicyFunc func(tried int) (time.Duration, bool)
+
+func (f RetryPolicyFunc) Next(tried int) (time.Duration, bool) {
+	return f(tried)
+}
+
+// FixedRetry retries with the same delay,
+// max is the most failed deliveries to accept, max < 1 means never give up.
+func FixedRetry(delay time.Duration, max int) RetryPolicy {
+	return RetryPolicyFunc(func(tried int) (time.Duration, bool) {
+		if max > 0 && tried >= max {
+			return 0, false
+		}
+		return delay, true
+	})
+}
+
+// ExponentialRetry doubles the delay from base on every failed delivery until maxDelay,
+// jitter in [0, 1] is the random part of the delay to avoid retry storms,
+// max is the most failed deliveries to accept, max < 1 means never give up.
+func ExponentialRetry(base, maxDelay time.Duration, max int, jitter float64) RetryPolicy {
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	return RetryPolicyFunc(func(tried int) (time.Duration, bool) {
+		if max > 0 && tried >= max {
+			return 0, false
+		}
+		delay := maxDelay
+		if shift := uint(tried - 1); tried > 0 && shift < 32 {
+			if d := base << shift; d > 0 && d < maxDelay {
+				delay = d
+			}
+		}
+		if jitter > 0 && delay > 0 {
+			part := time.Duration(float64(delay) * jitter)
+			delay = delay - part + time.Duration(rand.Int63n(int64(part)+1))
+		}
+		return delay, true
+	})
+}
+
+// RetryStep is a stair of StaircaseRetry, retry Times times with Delay.
+type RetryStep struct {
+	Times int
+	Delay time.Duration
+}
+
+// StaircaseRetry walks through the steps in order and gives up after the last one.
+func StaircaseRetry(steps ...RetryStep) RetryPolicy {
+	return RetryPolicyFunc(func(tried int) (time.Duration, bool) {
+		n := 0
+		for _, s := range steps {
+			n += s.Times
+			if tried <= n {
+				return s.Delay, true
+			}
+		}
+		return 0, false
+	})
+}
+
+// DefaultRetryPolicy is the schedule used when no policy is set:
+// 1 time after 3 seconds, 28 times every minute, 48 times every hour, then the job is given up.
+var DefaultRetryPolicy = StaircaseRetry(
+	RetryStep{1, 3 * time.Second},
+	RetryStep{28, time.Minute},
+	RetryStep{48, time.Hour},
+)
@@ -0,0 +1,66 @@
+package nsq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	cases := []struct {
+		tried int
+		delay time.Duration
+		ok    bool
+	}{
+		{1, 3 * time.Second, true},
+		{2, time.Minute, true},
+		{29, time.Minute, true},
+		{30, time.Hour, true},
+		{77, time.Hour, true},
+		{78, 0, false},
+	}
+	for _, c := range cases {
+		delay, ok := DefaultRetryPolicy.Next(c.tried)
+		if delay != c.delay || ok != c.ok {
+			t.Fatal(c.tried, delay, ok)
+		}
+	}
+}
+
+func TestFixedRetry(t *testing.T) {
+	p := FixedRetry(time.Second, 3)
+	for i := 1; i < 3; i++ {
+		if delay, ok := p.Next(i); delay != time.Second || !ok {
+			t.Fatal(i, delay, ok)
+		}
+	}
+	if _, ok := p.Next(3); ok {
+		t.Fatal("expect give up")
+	}
+	if _, ok := FixedRetry(time.Second, 0).Next(1 << 20); !ok {
+		t.Fatal("expect never give up")
+	}
+}
+
+func TestExponentialRetry(t *testing.T) {
+	p := ExponentialRetry(time.Second, time.Minute, 0, 0)
+	expect := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, e := range expect {
+		if delay, ok := p.Next(i + 1); delay != e || !ok {
+			t.Fatal(i+1, delay, ok)
+		}
+	}
+	if delay, _ := p.Next(100); delay != time.Minute {
+		t.Fatal(delay)
+	}
+
+	p = ExponentialRetry(time.Second, time.Minute, 10, 0.5)
+	for i := 0; i < 100; i++ {
+		delay, ok := p.Next(3)
+		if !ok || delay < 2*time.Second || delay > 4*time.Second {
+			t.Fatal(delay, ok)
+		}
+	}
+	if _, ok := p.Next(10); ok {
+		t.Fatal("expect give up")
+	}
+}
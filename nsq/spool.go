@@ -0,0 +1,604 @@
+package nsq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwaylib/errors"
+)
+
+// SyncPolicy is the fsync policy of the spool.
+type SyncPolicy int
+
+const (
+	// the spool is synced by the OS
+	SyncNever SyncPolicy = iota
+	// the spool is synced every second
+	SyncInterval
+	// the spool is synced after every append and replay
+	SyncAlways
+)
+
+const (
+	defaultSpoolSize   = 1 << 30
+	maxSpoolSegment    = 64 << 20
+	spoolSyncInterval  = time.Second
+	spoolRecordVersion = 1
+	spoolCursorName    = "cursor"
+	spoolSegmentExt    = ".spool"
+)
+
+// ErrSpoolFull the spool exceeds the max size.
+var ErrSpoolFull = errors.New("spool full")
+
+// NewSpoolProducer is the same as NewProducer, and the puts are appended to the segmented log of dir
+// when all the nsqd nodes are unreachable, Put returns nil after that.
+// The log is replayed in order in background when nsqd recovers, it's checked by the interval of WithHealthCheck,
+// and the puts are appended to the log too before it's empty to keep the order.
+// maxBytes is the max size of the log, default is 1GB, ErrSpoolFull is returned when it's full.
+// The log left by the last run is replayed after the restart, the error of opening the log is returned.
+func NewSpoolProducer(size int, addr, tube, dir string, policy SyncPolicy, maxBytes int64, opts ...ProducerOption) (Producer, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolSize
+	}
+	p := newProducer(size, addr, tube, opts...)
+	p.spool = &spool{dir: dir, policy: policy, maxBytes: maxBytes}
+	if err := p.spool.open(); err != nil {
+		return nil, errors.As(err)
+	}
+	p.start()
+	return p, nil
+}
+
+// spoolRecord is a put of the producer.
+type spoolRecord struct {
+	topic string
+	data  [][]byte
+	// delay of DPUB since at
+	delay time.Duration
+	at    time.Time
+}
+
+// publish publishes the record by PUB, MPUB or DPUB.
+func (rec *spoolRecord) publish(p *producer) error {
+	if rec.delay > 0 {
+		delay := rec.delay
+		if !rec.at.IsZero() {
+			delay -= time.Since(rec.at)
+		}
+		if delay > 0 {
+			return p.putDelay(rec.topic, rec.data[0], delay)
+		}
+	}
+	return p.putMany(rec.topic, rec.data)
+}
+
+// encode makes the record to
+// [4-byte size][4-byte crc32][1-byte version][8-byte at][8-byte delay][2-byte topic size][topic][4-byte count]([4-byte size][data])...
+func (rec *spoolRecord) encode() []byte {
+	size := 1 + 8 + 8 + 2 + len(rec.topic) + 4
+	for _, d := range rec.data {
+		size += 4 + len(d)
+	}
+	buf := make([]byte, 8+size)
+	payload := buf[8:]
+	payload[0] = spoolRecordVersion
+	binary.BigEndian.PutUint64(payload[1:], uint64(rec.at.UnixNano()))
+	binary.BigEndian.PutUint64(payload[9:], uint64(rec.delay))
+	binary.BigEndian.PutUint16(payload[17:], uint16(len(rec.topic)))
+	off := 19 + copy(payload[19:], rec.topic)
+	binary.BigEndian.PutUint32(payload[off:], uint32(len(rec.data)))
+	off += 4
+	for _, d := range rec.data {
+		binary.BigEndian.PutUint32(payload[off:], uint32(len(d)))
+		off += 4 + copy(payload[off+4:], d)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+func decodeSpoolRecord(payload []byte) (*spoolRecord, error) {
+	if len(payload) < 19 || payload[0] != spoolRecordVersion {
+		return nil, errors.New("invalid spool record")
+	}
+	rec := &spoolRecord{
+		at:    time.Unix(0, int64(binary.BigEndian.Uint64(payload[1:]))),
+		delay: time.Duration(binary.BigEndian.Uint64(payload[9:])),
+	}
+	off := 19 + int(binary.BigEndian.Uint16(payload[17:]))
+	if len(payload) < off+4 {
+		return nil, errors.New("invalid spool record")
+	}
+	rec.topic = string(payload[19:off])
+	count := int(binary.BigEndian.Uint32(payload[off:]))
+	off += 4
+	for i := 0; i < count; i++ {
+		if len(payload) < off+4 {
+			return nil, errors.New("invalid spool record")
+		}
+		size := int(binary.BigEndian.Uint32(payload[off:]))
+		off += 4
+		if len(payload) < off+size {
+			return nil, errors.New("invalid spool record")
+		}
+		rec.data = append(rec.data, payload[off:off+size])
+		off += size
+	}
+	if count == 0 {
+		return nil, errors.New("invalid spool record")
+	}
+	return rec, nil
+}
+
+// readSpoolRecord reads the payload of the record at off, n is the size of the record.
+func readSpoolRecord(f *os.File, off int64) (payload []byte, n int64, err error) {
+	head := make([]byte, 8)
+	if _, err := f.ReadAt(head, off); err != nil {
+		if err == io.EOF {
+			return nil, 0, err
+		}
+		return nil, 0, errors.As(err)
+	}
+	size := binary.BigEndian.Uint32(head)
+	if size > maxSpoolSegment {
+		return nil, 0, errors.New("invalid spool record size").As(f.Name(), off, size)
+	}
+	payload = make([]byte, size)
+	if _, err := f.ReadAt(payload, off+8); err != nil {
+		return nil, 0, errors.As(err, f.Name(), off)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(head[4:]) {
+		return nil, 0, errors.New("invalid spool record crc").As(f.Name(), off)
+	}
+	return payload, int64(8 + size), nil
+}
+
+// spool is the segmented log of the puts, the segments are named by the sequence,
+// and the read position is kept in the cursor file.
+type spool struct {
+	dir         string
+	policy      SyncPolicy
+	maxBytes    int64
+	segmentSize int64
+
+	mu sync.Mutex
+	// sequences of the segments, the last one is written
+	segments []int64
+	w        *os.File
+	wsize    int64
+	// bytes of all the segments
+	size  int64
+	dirty bool
+
+	// read position, and the size of the record read
+	cursor *os.File
+	r      *os.File
+	rseq   int64
+	roff   int64
+	rn     int64
+
+	exit chan bool
+	wg   sync.WaitGroup
+}
+
+func (s *spool) segmentPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// open recovers the log of the last run, the records broken by a crash are truncated.
+func (s *spool) open() (err error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return errors.As(err, s.dir)
+	}
+	s.segmentSize = maxSpoolSegment
+	if s.maxBytes/4 < s.segmentSize {
+		s.segmentSize = s.maxBytes / 4
+	}
+
+	cursor, err := os.OpenFile(filepath.Join(s.dir, spoolCursorName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.As(err, s.dir)
+	}
+	s.cursor = cursor
+	defer func() {
+		if err != nil {
+			// the spool is not used after the failure.
+			if s.w != nil {
+				s.w.Close()
+			}
+			cursor.Close()
+		}
+	}()
+	pos := make([]byte, 16)
+	if _, err := cursor.ReadAt(pos, 0); err == nil {
+		s.rseq = int64(binary.BigEndian.Uint64(pos))
+		s.roff = int64(binary.BigEndian.Uint64(pos[8:]))
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return errors.As(err, s.dir)
+	}
+	for _, name := range names {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq < s.rseq {
+			// replayed already
+			os.Remove(name)
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	if len(s.segments) == 0 {
+		if s.rseq == 0 {
+			s.rseq = 1
+		}
+		s.segments = []int64{s.rseq}
+	}
+	if s.segments[0] != s.rseq {
+		s.rseq, s.roff = s.segments[0], 0
+	}
+
+	for _, seq := range s.segments {
+		off := int64(0)
+		if seq == s.rseq {
+			off = s.roff
+		}
+		size, err := s.recover(seq, off)
+		if err != nil {
+			return errors.As(err)
+		}
+		if seq == s.rseq && s.roff > size {
+			s.roff = size
+		}
+		s.size += size
+	}
+
+	last := s.segments[len(s.segments)-1]
+	w, err := os.OpenFile(s.segmentPath(last), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.As(err, s.dir)
+	}
+	fi, err := w.Stat()
+	if err != nil {
+		w.Close()
+		return errors.As(err, s.dir)
+	}
+	s.w, s.wsize = w, fi.Size()
+	if err := s.writeCursor(); err != nil {
+		return errors.As(err)
+	}
+
+	s.exit = make(chan bool)
+	if s.policy == SyncInterval {
+		s.wg.Add(1)
+		go s.syncLoop()
+	}
+	return nil
+}
+
+// recover checks the records of the segment from off, and truncates the broken tail, it returns the valid size.
+func (s *spool) recover(seq, off int64) (int64, error) {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, errors.As(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, errors.As(err)
+	}
+	if off > fi.Size() {
+		off = fi.Size()
+	}
+	for off < fi.Size() {
+		_, n, err := readSpoolRecord(f, off)
+		if err != nil {
+			break
+		}
+		off += n
+	}
+	if off < fi.Size() {
+		if err := f.Truncate(off); err != nil {
+			return 0, errors.As(err)
+		}
+	}
+	return off, nil
+}
+
+func (s *spool) syncLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(spoolSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.exit:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.dirty && s.w != nil {
+				s.w.Sync()
+				s.cursor.Sync()
+				s.dirty = false
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// synced syncs the files by the policy, need lock.
+func (s *spool) synced(f *os.File) error {
+	switch s.policy {
+	case SyncAlways:
+		return f.Sync()
+	case SyncInterval:
+		s.dirty = true
+	}
+	return nil
+}
+
+func (s *spool) writeCursor() error {
+	pos := make([]byte, 16)
+	binary.BigEndian.PutUint64(pos, uint64(s.rseq))
+	binary.BigEndian.PutUint64(pos[8:], uint64(s.roff))
+	if _, err := s.cursor.WriteAt(pos, 0); err != nil {
+		return errors.As(err)
+	}
+	return s.synced(s.cursor)
+}
+
+func (s *spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isEmpty()
+}
+
+// isEmpty need lock.
+func (s *spool) isEmpty() bool {
+	return s.rseq == s.segments[len(s.segments)-1] && s.roff >= s.wsize
+}
+
+func (s *spool) bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *spool) append(rec *spoolRecord) error {
+	rec.at = time.Now()
+	buf := rec.encode()
+	n := int64(len(buf))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return errors.New("spool closed").As(s.dir)
+	}
+	if s.size+n > s.maxBytes {
+		return ErrSpoolFull.As(s.dir, s.size)
+	}
+	if s.wsize > 0 && s.wsize+n > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return errors.As(err)
+		}
+	}
+	if _, err := s.w.Write(buf); err != nil {
+		// drop the part written
+		s.w.Truncate(s.wsize)
+		return errors.As(err, s.dir)
+	}
+	s.wsize += n
+	s.size += n
+	return s.synced(s.w)
+}
+
+// rotate writes the next segment, need lock.
+func (s *spool) rotate() error {
+	seq := s.segments[len(s.segments)-1] + 1
+	w, err := os.OpenFile(s.segmentPath(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.As(err, s.dir)
+	}
+	if s.policy != SyncNever {
+		s.w.Sync()
+	}
+	s.w.Close()
+	s.w, s.wsize = w, 0
+	s.segments = append(s.segments, seq)
+	return nil
+}
+
+// next returns the record at the read position, or nil if the spool is empty.
+func (s *spool) next() (*spoolRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.isEmpty() {
+			return nil, nil
+		}
+		if s.r == nil {
+			r, err := os.Open(s.segmentPath(s.rseq))
+			if err != nil {
+				return nil, errors.As(err)
+			}
+			s.r = r
+		}
+		payload, n, err := readSpoolRecord(s.r, s.roff)
+		if err == io.EOF && s.rseq != s.segments[len(s.segments)-1] {
+			// the segment is replayed
+			if err := s.nextSegment(); err != nil {
+				return nil, errors.As(err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, errors.As(err)
+		}
+		rec, err := decodeSpoolRecord(payload)
+		if err != nil {
+			return nil, errors.As(err, s.r.Name(), s.roff)
+		}
+		s.rn = n
+		return rec, nil
+	}
+}
+
+// nextSegment removes the segment read, need lock.
+func (s *spool) nextSegment() error {
+	fi, err := os.Stat(s.segmentPath(s.rseq))
+	if err != nil {
+		return errors.As(err)
+	}
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	if err := os.Remove(s.segmentPath(s.rseq)); err != nil {
+		return errors.As(err)
+	}
+	s.size -= fi.Size()
+	s.segments = s.segments[1:]
+	s.rseq, s.roff = s.segments[0], 0
+	return s.writeCursor()
+}
+
+// skip drops the rest of the segment read when it's broken.
+func (s *spool) skip() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rseq != s.segments[len(s.segments)-1] {
+		return s.nextSegment()
+	}
+	s.roff = s.wsize
+	return s.commit()
+}
+
+// done moves the read position to the next record.
+func (s *spool) done() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roff += s.rn
+	s.rn = 0
+	return s.commit()
+}
+
+// commit writes the read position, and reuses the segment when all are replayed, need lock.
+func (s *spool) commit() error {
+	if s.isEmpty() {
+		if err := s.w.Truncate(0); err != nil {
+			return errors.As(err)
+		}
+		s.wsize, s.size, s.roff = 0, 0, 0
+	}
+	return s.writeCursor()
+}
+
+func (s *spool) close() error {
+	close(s.exit)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	if s.policy != SyncNever {
+		s.w.Sync()
+		s.cursor.Sync()
+	}
+	s.w.Close()
+	s.w = nil
+	return s.cursor.Close()
+}
+
+// send publishes the record, it's appended to the spool when the nsqd nodes are unreachable.
+func (p *producer) send(rec *spoolRecord) error {
+	if p.spool == nil {
+		return rec.publish(p)
+	}
+	if !p.spool.empty() {
+		// keep the order
+		return p.spoolPut(rec)
+	}
+	err := rec.publish(p)
+	if err == nil || !isNodeErr(err) {
+		return err
+	}
+	if serr := p.spoolPut(rec); serr != nil {
+		return errors.As(serr, err)
+	}
+	return nil
+}
+
+func (p *producer) spoolPut(rec *spoolRecord) error {
+	if err := p.spool.append(rec); err != nil {
+		return err
+	}
+	p.metrics.Add(metricProducerSpooled, float64(len(rec.data)), "topic", rec.topic)
+	p.metrics.Set(metricProducerSpoolBytes, float64(p.spool.bytes()))
+	return nil
+}
+
+// replay publishes the spooled puts in order by the interval of the health check.
+func (p *producer) replay() {
+	defer p.replayWg.Done()
+	ticker := time.NewTicker(p.probeInterval)
+	defer ticker.Stop()
+	for {
+		p.drain()
+		select {
+		case <-p.sig_exit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain publishes the spooled puts until the spool is empty or nsqd is unreachable.
+func (p *producer) drain() {
+	for {
+		select {
+		case <-p.sig_exit:
+			return
+		default:
+		}
+		rec, err := p.spool.next()
+		if err != nil {
+			p.log.Error(errors.As(err, "skip the broken spool"))
+			if err := p.spool.skip(); err != nil {
+				p.log.Warn(errors.As(err))
+				return
+			}
+			continue
+		}
+		if rec == nil {
+			return
+		}
+		if err := rec.publish(p); err != nil {
+			if isNodeErr(err) {
+				// try again later
+				return
+			}
+			// it can't be published anyway.
+			p.log.Error(errors.As(err, "drop the spooled put", rec.topic))
+		}
+		if err := p.spool.done(); err != nil {
+			p.log.Warn(errors.As(err))
+		}
+		p.metrics.Set(metricProducerSpoolBytes, float64(p.spool.bytes()))
+	}
+}
@@ -0,0 +1,155 @@
+package nsq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpoolRecord(t *testing.T) {
+	rec := &spoolRecord{topic: "testing_tube", data: [][]byte{[]byte("a"), []byte("bc")}, delay: time.Second, at: time.Now()}
+	buf := rec.encode()
+	out, err := decodeSpoolRecord(buf[8:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.topic != rec.topic || len(out.data) != 2 || string(out.data[1]) != "bc" || out.delay != rec.delay || !out.at.Equal(rec.at) {
+		t.Fatal(out)
+	}
+	if _, err := decodeSpoolRecord(buf[8 : len(buf)-1]); err == nil {
+		t.Fatal("expect invalid record")
+	}
+}
+
+func TestProducerSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	down := freeAddr(t)
+
+	p, err := NewSpoolProducer(1, down, "testing_tube", dir, SyncAlways, 400, WithHealthCheck(1, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"1", "2"} {
+		if err := p.Put([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.PutMany([][]byte{[]byte("3"), []byte("4")}); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	// a broken record left by a crash.
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if len(segments) < 2 {
+		t.Fatal(segments)
+	}
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1})
+	f.Close()
+
+	// replayed in order after the restart.
+	s := newTestNsqd(t, func(s *testNsqd) {
+		s.listen = down
+	})
+	defer s.Close()
+	p, err = NewSpoolProducer(1, down, "testing_tube", dir, SyncInterval, 400, WithHealthCheck(1, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Put([]byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Wait(5*time.Second, func() bool {
+		pub := []string{}
+		for _, data := range s.pub["testing_tube"] {
+			pub = append(pub, string(data))
+		}
+		return strings.Join(pub, ",") == "1,2,3,4,5"
+	}) {
+		t.Fatal(s.pub["testing_tube"])
+	}
+	sp := p.(*producer).spool
+	deadline := time.Now().Add(time.Second)
+	for !sp.empty() || sp.bytes() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal(sp.bytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*.spool")); len(segments) != 1 {
+		t.Fatal(segments)
+	}
+
+	// published directly after replaying.
+	if err := p.Put([]byte("6")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Wait(0, func() bool { return len(s.pub["testing_tube"]) == 6 }) {
+		t.Fatal("not published")
+	}
+}
+
+func TestProducerSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsq-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := NewSpoolProducer(1, freeAddr(t), "testing_tube", dir, SyncNever, 64, WithHealthCheck(1, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+	// not spooled
+	if err := p.Put([]byte("testing")); !ErrSpoolFull.Equal(err) {
+		t.Fatal(err)
+	}
+	if err := p.PutTopic("a!b", []byte("testing")); !ErrSpoolFull.Equal(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestNewSpoolProducer(t *testing.T) {
+	f, err := ioutil.TempFile("", "nsq-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	// the dir is a file
+	if _, err := NewSpoolProducer(1, freeAddr(t), "testing_tube", f.Name(), SyncNever, 0); err == nil {
+		t.Fatal("expect error")
+	}
+
+	dir, err := ioutil.TempDir("", "nsq-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p, err := NewSpoolProducer(1, freeAddr(t), "testing_tube", dir, SyncNever, 0, WithHealthCheck(1, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// spooled
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+}
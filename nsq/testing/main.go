@@ -35,12 +35,12 @@ func main() {
 	// 等待消费者就绪
 	time.Sleep(1e9)
 
-	// 生产者
-	p := nsq.NewProducer(100, addr, tube)
+	// 生产者, 批量发送
+	p := nsq.NewProducer(100, addr, tube, nsq.WithBatch(100, 0, 10*time.Millisecond))
 	eventSize := 50000000
 	seed := time.Now().UnixNano()
 	buffer := make(chan int64, 1000)
-	for i := 1; i > 0; i-- {
+	for i := 1000; i > 0; i-- {
 		go func() {
 			for {
 				in := <-buffer
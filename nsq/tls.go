@@ -0,0 +1,93 @@
+package nsq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gwaylib/errors"
+)
+
+var (
+	// ErrAuthRequired is returned when nsqd requires AUTH but no secret is set.
+	ErrAuthRequired = errors.New("nsqd requires auth secret")
+	// ErrAuthFailed is returned when nsqd rejects the auth secret.
+	ErrAuthFailed = errors.New("nsqd auth failed")
+	// ErrTLS is returned when the TLS upgrade with nsqd is failed.
+	ErrTLS = errors.New("nsqd tls failed")
+)
+
+// NewTLSConfig makes the TLS config of the nsqd connections,
+// caFile is the PEM bundle of the CAs to verify nsqd, default is the system CAs,
+// certFile and keyFile are the PEM client certificate, they're skipped when empty.
+func NewTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(caFile) > 0 {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.As(err, caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate found").As(caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.As(err, certFile, keyFile)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// WithTLS enables TLS of the nsqd connections, see NewTLSConfig.
+// The server name is set to the host of nsqd address by go-nsq.
+func WithTLS(cfg *tls.Config) ConsumerOption {
+	return func(c *consumer) {
+		c.tlsConfig = cfg
+	}
+}
+
+// WithAuthSecret sets the secret of AUTH which is sent when nsqd requires.
+func WithAuthSecret(secret string) ConsumerOption {
+	return func(c *consumer) {
+		c.authSecret = secret
+	}
+}
+
+// WithProducerTLS enables TLS of the producer connections, see WithTLS.
+func WithProducerTLS(cfg *tls.Config) ProducerOption {
+	return func(p *producer) {
+		p.tlsConfig = cfg
+	}
+}
+
+// WithProducerAuthSecret sets the secret of AUTH for the producer connections.
+func WithProducerAuthSecret(secret string) ProducerOption {
+	return func(p *producer) {
+		p.authSecret = secret
+	}
+}
+
+// connError makes the error of connecting nsqd checkable by ErrAuthRequired, ErrAuthFailed and ErrTLS.
+func connError(err error, addr string) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "Auth Required"):
+		return ErrAuthRequired.As(addr)
+	case strings.Contains(msg, "Error authenticating"), strings.Contains(msg, "E_AUTH"), strings.Contains(msg, "E_UNAUTHORIZED"):
+		return ErrAuthFailed.As(addr, msg)
+	case strings.Contains(msg, "tls:"), strings.Contains(msg, "x509:"), strings.Contains(msg, "TLS"):
+		return ErrTLS.As(addr, msg)
+	}
+	return errors.As(err, addr)
+}
+
+// isSecurityErr reports the error can't be fixed by reconnecting.
+func isSecurityErr(err error) bool {
+	return ErrAuthRequired.Equal(err) || ErrAuthFailed.Equal(err) || ErrTLS.Equal(err)
+}
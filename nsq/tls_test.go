@@ -0,0 +1,175 @@
+package nsq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwaylib/errors"
+)
+
+// testCerts is a CA and the server and client certificates signed by it.
+type testCerts struct {
+	dir                string
+	ca, server, client string
+}
+
+func newTestCerts(t *testing.T) *testCerts {
+	dir, err := ioutil.TempDir("", "nsq-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := &testCerts{dir: dir}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "testing ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDer)
+	certs.ca = certs.write(t, "ca", caDer, nil)
+
+	for i, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: "testing"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage == x509.ExtKeyUsageServerAuth {
+			certs.server = certs.write(t, "server", der, key)
+		} else {
+			certs.client = certs.write(t, "client", der, key)
+		}
+	}
+	return certs
+}
+
+// write writes name.pem and name.key, and returns the prefix of them.
+func (c *testCerts) write(t *testing.T, name string, der []byte, key *ecdsa.PrivateKey) string {
+	prefix := filepath.Join(c.dir, name)
+	if err := ioutil.WriteFile(prefix+".pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if key != nil {
+		data, _ := x509.MarshalECPrivateKey(key)
+		if err := ioutil.WriteFile(prefix+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: data}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return prefix
+}
+
+func (c *testCerts) Close() {
+	os.RemoveAll(c.dir)
+}
+
+// newTestTLSNsqd starts a nsqd which requires the client certificate and the auth secret.
+func newTestTLSNsqd(t *testing.T, certs *testCerts, secret string) *testNsqd {
+	cfg, err := NewTLSConfig(certs.ca+".pem", certs.server+".pem", certs.server+".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ClientCAs = cfg.RootCAs
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return newTestNsqd(t, func(s *testNsqd) {
+		s.tlsConfig = cfg
+		s.authSecret = secret
+	})
+}
+
+func TestTLSAuth(t *testing.T) {
+	certs := newTestCerts(t)
+	defer certs.Close()
+	s := newTestTLSNsqd(t, certs, "secret")
+	defer s.Close()
+
+	cfg, err := NewTLSConfig(certs.ca+".pem", certs.client+".pem", certs.client+".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProducer(1, s.Addr(), "testing_tube", WithProducerTLS(cfg), WithProducerAuthSecret("secret"))
+	defer p.Close()
+	if err := p.Put([]byte("testing")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConsumer(s.Addr(), "testing_tube", WithTLS(cfg), WithAuthSecret("secret"))
+	defer c.Close()
+	go c.ReserveHandler(time.Minute, func(ctx context.Context, job *Job, tried int) error {
+		return nil
+	})
+	if !s.Wait(5*time.Second, func() bool { return len(s.fin) == 1 }) {
+		t.Fatal("not finished")
+	}
+}
+
+func TestTLSAuthError(t *testing.T) {
+	certs := newTestCerts(t)
+	defer certs.Close()
+	s := newTestTLSNsqd(t, certs, "secret")
+	defer s.Close()
+
+	cfg, err := NewTLSConfig(certs.ca+".pem", certs.client+".pem", certs.client+".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noCert, err := NewTLSConfig(certs.ca+".pem", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noCA, err := NewTLSConfig("", certs.client+".pem", certs.client+".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []struct {
+		opts   []ProducerOption
+		expect error
+	}{
+		{[]ProducerOption{WithProducerTLS(cfg)}, ErrAuthRequired},
+		{[]ProducerOption{WithProducerTLS(cfg), WithProducerAuthSecret("wrong")}, ErrAuthFailed},
+		{[]ProducerOption{WithProducerTLS(noCert), WithProducerAuthSecret("secret")}, ErrTLS},
+		{[]ProducerOption{WithProducerTLS(noCA), WithProducerAuthSecret("secret")}, ErrTLS},
+	} {
+		p := NewProducer(1, s.Addr(), "testing_tube", c.opts...)
+		err := p.Put([]byte("testing"))
+		p.Close()
+		if !errors.Equal(c.expect, err) {
+			t.Fatal(i, err)
+		}
+	}
+
+	if _, err := NewTLSConfig(certs.client+".key", "", ""); err == nil {
+		t.Fatal("expect no certificate")
+	}
+}
@@ -0,0 +1,252 @@
+package nsq
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gwaylib/errors"
+)
+
+// worker runs the handler goroutines of a Reserve call,
+// the messages are dispatched from the connections shared by the consumer.
+type worker struct {
+	*consumer
+
+	// parent of the handler context, the worker exits when it's done.
+	ctx context.Context
+
+	// handle which is pushed
+	handle Handler
+
+	// work timeout for dealock
+	workout time.Duration
+
+	// signal command.
+	closeOnce sync.Once
+	sig_exit  chan bool
+	wg        sync.WaitGroup
+}
+
+func newWorker(ctx context.Context, c *consumer, handle Handler, timeout time.Duration) *worker {
+	return &worker{
+		consumer: c,
+		ctx:      ctx,
+		handle:   handle,
+		workout:  timeout,
+		sig_exit: make(chan bool),
+	}
+}
+
+// reserve starts n handler goroutines and waits for them exiting.
+func (c *worker) reserve(n int) {
+	for i := n; i > 0; i-- {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.loop()
+		}()
+	}
+	c.wg.Wait()
+}
+
+func (c *worker) loop() {
+	for {
+		select {
+		case <-c.sig_exit:
+			return
+		case <-c.ctx.Done():
+			return
+		case msg := <-c.delegate.msg:
+			job := &Job{ID: msg.ID, Body: msg.Body, msg: msg}
+			if c.deferred(job) {
+				continue
+			}
+			job.unwrap()
+			if err := c.do(job); err != nil {
+				// stopped by the parent context.
+				return
+			}
+		}
+	}
+}
+
+func (c *worker) Close() error {
+	c.stop()
+	c.wait()
+	return nil
+}
+
+// stop stops the handler goroutines taking new messages.
+func (c *worker) stop() {
+	c.closeOnce.Do(func() {
+		close(c.sig_exit)
+	})
+}
+
+// wait waits for the handler goroutines exiting.
+func (c *worker) wait() {
+	c.wg.Wait()
+}
+
+// do job, it returns error only when the parent context is done.
+func (c *worker) do(job *Job) error {
+	result := make(chan bool)
+	ctx, cancel := context.WithTimeout(c.ctx, c.workout)
+	defer cancel()
+
+	job.cancel = cancel
+	c.addJob(job)
+	go func(ctx context.Context) {
+		var handleErr error
+		times := job.tried()
+		start := time.Now()
+
+		defer close(result)
+		defer func() {
+			// recover for handle
+			if r := recover(); r != nil {
+				c.metrics.Add(metricConsumerPanics, 1, c.labels()...)
+				handleErr = Retry(errors.New("panic").As(r))
+				c.log.Error(handleErr)
+				debug.PrintStack()
+			}
+			c.metrics.since(metricConsumerHandle, start, c.labels()...)
+
+			if !job.settle() {
+				// the job has been requeued by timeout or shutdown.
+				c.metrics.Add(metricConsumerLateResults, 1, c.labels()...)
+				c.log.Warn(errors.New("ignore late result").As(string(job.ID[:]), handleErr))
+				return
+			}
+			c.finish(job, handleErr)
+			c.doneJob(job)
+		}()
+
+		handleErr = c.handle(ctx, job, times)
+	}(ctx)
+
+	// keep the job in flight until the handler timeout.
+	touch := time.NewTicker(c.touchInterval())
+	defer touch.Stop()
+	for {
+		select {
+		case <-result:
+			return nil
+		case <-touch.C:
+			job.Touch()
+		case <-ctx.Done():
+			if err := c.ctx.Err(); err != nil {
+				return err
+			}
+			if !job.settle() {
+				// the result is coming.
+				<-result
+				return nil
+			}
+			c.metrics.Add(metricConsumerTimeouts, 1, c.labels()...)
+			c.log.Warn(errors.New("handle time out").As(ctx.Err(), string(job.ID[:])))
+			c.timeout(job)
+			c.doneJob(job)
+			return nil
+		}
+	}
+}
+
+// timeout requeues the job which exceeds the handler timeout, the handler goroutine may still be running.
+func (c *worker) timeout(job *Job) {
+	if c.timeoutDelay >= 0 {
+		c.requeue(job, c.timeoutDelay, true)
+		return
+	}
+	c.nextTry(job, errors.New("handle time out"))
+}
+
+// finish does the next step of the job by the error returned from handler.
+func (c *worker) finish(job *Job, handleErr error) {
+	o := outcomeOf(handleErr)
+	c.metrics.Add(metricConsumerMessages, 1, c.labels("action", o.Action.String())...)
+	switch o.Action {
+	case ActionAck:
+		c.delJob(job)
+	case ActionDrop:
+		c.log.Warn(errors.New("drop data").As(o.Err, string(job.Body)))
+		c.delJob(job)
+	case ActionDeadLetter:
+		c.giveUp(job, job.tried()+1, o.Err)
+	case ActionRetryAfter:
+		c.requeue(job, o.Delay, false)
+	default:
+		c.nextTry(job, o.Err)
+	}
+}
+
+func (c *worker) nextTry(job *Job, cause error) {
+	// the current delivery is failed too.
+	times := job.tried() + 1
+
+	// 若发送不成功, 按重试策略的间隔再次尝试发送, 策略放弃后数据将被删除或转入死信队列
+	sleep, ok := c.retry.Next(times)
+	if !ok {
+		c.giveUp(job, times, cause)
+		return
+	}
+	c.requeue(job, sleep, true)
+}
+
+// giveUp sends the job to the dead-letter topic, or deletes it if there is no dead-letter topic.
+func (c *worker) giveUp(job *Job, times int, cause error) {
+	if c.deadLetter == nil {
+		c.log.Warn(errors.New("delete data").As(times, cause, string(job.Body)))
+		// delete job
+		c.delJob(job)
+		return
+	}
+	if err := c.putDeadLetter(job, times, cause); err != nil {
+		// keep the job and try the dead letter again later.
+		c.log.Error(errors.As(err, job))
+		c.requeue(job, time.Minute, true)
+		return
+	}
+	c.metrics.Add(metricConsumerDeadLetters, 1, c.labels()...)
+	c.delJob(job)
+}
+
+func (c *worker) putDeadLetter(job *Job, times int, cause error) error {
+	d := &DeadLetter{
+		Topic:     c.tube,
+		Attempts:  times,
+		FirstSeen: job.Timestamp,
+		LastSeen:  time.Now(),
+		Headers:   job.Headers,
+		Body:      job.Body,
+	}
+	if cause != nil {
+		d.LastError = cause.Error()
+	}
+	data, err := d.Encode()
+	if err != nil {
+		return errors.As(err)
+	}
+	if err := c.deadLetter.Put(data); err != nil {
+		return errors.As(err)
+	}
+	return nil
+}
+
+// requeue and delJob respond through the connection which delivered the job,
+// so the messages in flight of the connection are counted.
+// backoff tells the consumer the job is failed.
+func (c *worker) requeue(job *Job, delay time.Duration, backoff bool) {
+	c.metrics.Add(metricConsumerRequeues, 1, c.labels()...)
+	if backoff {
+		job.msg.Requeue(delay)
+		return
+	}
+	job.msg.RequeueWithoutBackoff(delay)
+}
+
+func (c *worker) delJob(job *Job) {
+	job.msg.Finish()
+}